@@ -1,21 +1,49 @@
 package main
 
 import (
+    "encoding/json"
+    "math"
     "net/http"
+    "strconv"
     "time"
 )
 
 type RateLimiter struct {
-    tokens   chan struct{}
-    refill   *time.Ticker
-    capacity int
+    tokens     chan struct{}
+    refill     *time.Ticker
+    capacity   int
+    refillRate time.Duration
+    
+    // Rejection controls what Middleware sends back when a request is limited
+    Rejection RejectionConfig
+}
+
+// RejectionConfig describes the response for a rate limited request
+type RejectionConfig struct {
+    StatusCode  int    // defaults to 429 Too Many Requests
+    Body        string // plain text body, or the problem detail
+    ProblemJSON bool   // respond with application/problem+json (RFC 7807)
+    ProblemType string // problem "type" URI, defaults to about:blank
+}
+
+type problemDetails struct {
+    Type       string `json:"type"`
+    Title      string `json:"title"`
+    Status     int    `json:"status"`
+    Detail     string `json:"detail,omitempty"`
+    RetryAfter int    `json:"retry_after,omitempty"`
 }
 
 func NewRateLimiter(capacity int, refillRate time.Duration) *RateLimiter {
     rl := &RateLimiter{
-        tokens:   make(chan struct{}, capacity),
-        refill:   time.NewTicker(refillRate),
-        capacity: capacity,
+        tokens:     make(chan struct{}, capacity),
+        refill:     time.NewTicker(refillRate),
+        capacity:   capacity,
+        refillRate: refillRate,
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusTooManyRequests,
+            Body:       "Rate limit exceeded",
+        },
     }
     
     // Fill bucket initially
@@ -53,19 +81,112 @@ func (rl *RateLimiter) Wait() {
     <-rl.tokens
 }
 
+// Refund returns a token taken by Allow, e.g. when a later check rejected
+// the request. Tokens beyond capacity are dropped.
+func (rl *RateLimiter) Refund() {
+    select {
+    case rl.tokens <- struct{}{}:
+    default:
+    }
+}
+
+// Remaining returns the number of tokens currently in the bucket
+func (rl *RateLimiter) Remaining() int {
+    return len(rl.tokens)
+}
+
+// ResetAfter returns how long until the bucket is full again
+func (rl *RateLimiter) ResetAfter() time.Duration {
+    return time.Duration(rl.capacity-rl.Remaining()) * rl.refillRate
+}
+
+// RetryAfter returns how long a rejected client should wait for the next token
+func (rl *RateLimiter) RetryAfter() time.Duration {
+    return rl.refillRate
+}
+
+// Window returns the time it takes to refill an empty bucket
+func (rl *RateLimiter) Window() time.Duration {
+    return time.Duration(rl.capacity) * rl.refillRate
+}
+
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        if !rl.Allow() {
-            http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+        allowed := rl.Allow()
+        rl.writeHeaders(w)
+        
+        if !allowed {
+            rl.reject(w)
             return
         }
         next.ServeHTTP(w, r)
     })
 }
 
+func (rl *RateLimiter) writeHeaders(w http.ResponseWriter) {
+    setRateLimitHeaders(w, rl.capacity, rl.Remaining(), rl.ResetAfter(), rl.Window())
+}
+
+// setRateLimitHeaders sets the IETF draft RateLimit-* response headers
+func setRateLimitHeaders(w http.ResponseWriter, limit, remaining int, reset, window time.Duration) {
+    h := w.Header()
+    h.Set("RateLimit-Limit", strconv.Itoa(limit))
+    h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+    h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+    h.Set("RateLimit-Policy", strconv.Itoa(limit)+";w="+strconv.Itoa(ceilSeconds(window)))
+}
+
+func (rl *RateLimiter) reject(w http.ResponseWriter) {
+    writeRejection(w, rl.Rejection, rl.RetryAfter())
+}
+
+// writeRejection sets Retry-After and writes the configured rejection response
+func writeRejection(w http.ResponseWriter, cfg RejectionConfig, wait time.Duration) {
+    retryAfter := ceilSeconds(wait)
+    if retryAfter < 1 {
+        retryAfter = 1
+    }
+    w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+    
+    status := cfg.StatusCode
+    if status == 0 {
+        status = http.StatusTooManyRequests
+    }
+    
+    if !cfg.ProblemJSON {
+        http.Error(w, cfg.Body, status)
+        return
+    }
+    
+    problem := problemDetails{
+        Type:       cfg.ProblemType,
+        Title:      http.StatusText(status),
+        Status:     status,
+        Detail:     cfg.Body,
+        RetryAfter: retryAfter,
+    }
+    if problem.Type == "" {
+        problem.Type = "about:blank"
+    }
+    
+    w.Header().Set("Content-Type", "application/problem+json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(problem)
+}
+
+// ceilSeconds rounds a duration up to whole seconds for header values
+func ceilSeconds(d time.Duration) int {
+    if d <= 0 {
+        return 0
+    }
+    return int(math.Ceil(d.Seconds()))
+}
+
 // Usage
 func main() {
     limiter := NewRateLimiter(10, 100*time.Millisecond) // 10 requests per second
+    limiter.Rejection.ProblemJSON = true
     
     http.Handle("/api", limiter.Middleware(http.HandlerFunc(apiHandler)))
     http.ListenAndServe(":8080", nil)
@@ -1,31 +1,98 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "errors"
+    "fmt"
     "net/http"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
     "time"
 )
 
+var (
+    ErrKeyNotFound  = errors.New("key not found")
+    ErrNotInteger   = errors.New("value is not an integer")
+    ErrUnknownOp    = errors.New("unknown cache operation")
+    ErrNotBatchable = errors.New("operation not allowed in a batch")
+    ErrCacheClosed  = errors.New("cache server closed")
+    ErrReadOnly     = errors.New("cache server is a read-only replica")
+)
+
+type CacheOp int
+
+const (
+    OpGet CacheOp = iota
+    OpSet
+    OpDelete
+    OpExists
+    OpIncr
+    OpDecr
+    OpCompareAndSwap
+    OpKeys
+    OpLoad     // Get, or make the caller the single loader for a missing key
+    OpLoadDone // loader result, answers every request waiting on the key
+    OpBatch    // apply Batch in order within one actor turn
+    OpSetIfAbsent
+    OpCompareAndDelete
+    
+    // Replication, see cache_replication.go
+    OpSnapshot
+    OpRestore
+    OpReplicate
+    OpObserve
+    OpSetReadOnly
+)
+
 type CacheRequest struct {
+    Op       CacheOp
     Key      string
-    Value    interface{}
+    Value    interface{}   // Set value, CompareAndSwap new value
+    Old      interface{}   // CompareAndSwap/CompareAndDelete expected value
+    Delta    int64         // Incr/Decr amount
+    TTL      time.Duration // Set/LoadDone expiry, 0 never expires; CompareAndSwap keeps the old one
+    ResetTTL bool          // CompareAndSwap uses TTL even when it is 0, like Set
+    Err      error         // LoadDone loader error
+    Batch    []CacheRequest
     Response chan CacheResponse
 }
 
 type CacheResponse struct {
     Value  interface{}
     Exists bool
+    Keys   []string
+    Batch  []CacheResponse
+    Err    error
 }
 
 type CacheServer struct {
     requests chan CacheRequest
     cache    map[string]interface{}
+    expiry   map[string]time.Time
+    timers   expiryHeap
+    loading  map[string][]chan CacheResponse
+    
+    // Replication state, also owned by the run goroutine
+    seq      uint64
+    observer func(Mutation)
+    readOnly bool
+    
+    closeOnce sync.Once
+    quit      chan struct{} // closed by Close, no new requests accepted
+    done      chan struct{} // closed when run has drained and exited
 }
 
 func NewCacheServer() *CacheServer {
     cs := &CacheServer{
         requests: make(chan CacheRequest),
         cache:    make(map[string]interface{}),
+        expiry:   make(map[string]time.Time),
+        loading:  make(map[string][]chan CacheResponse),
+        quit:     make(chan struct{}),
+        done:     make(chan struct{}),
     }
     
     // Single goroutine manages all cache operations
@@ -35,53 +102,448 @@ func NewCacheServer() *CacheServer {
 }
 
 func (cs *CacheServer) run() {
-    for req := range cs.requests {
-        if req.Value != nil {
-            // Set operation
-            cs.cache[req.Key] = req.Value
-            req.Response <- CacheResponse{Value: req.Value, Exists: true}
+    defer close(cs.done)
+    
+    timer := time.NewTimer(time.Hour)
+    timer.Stop()
+    
+    for {
+        select {
+        case req := <-cs.requests:
+            cs.handle(req)
+        
+        case now := <-timer.C:
+            cs.expireDue(now)
+        
+        case <-cs.quit:
+            cs.drain()
+            return
+        }
+        
+        // Wake up for the earliest expiry
+        if next, ok := cs.timers.next(); ok {
+            timer.Reset(time.Until(next))
+        }
+    }
+}
+
+// handle applies req and answers it unless the answer is deferred. Response
+// channels are buffered so an abandoned caller never blocks the actor.
+func (cs *CacheServer) handle(req CacheRequest) {
+    resp, reply := cs.apply(req)
+    cs.publish(req, resp)
+    
+    if reply {
+        req.Response <- resp
+    }
+}
+
+// mutates reports whether op can change the cache contents
+func mutates(op CacheOp) bool {
+    switch op {
+    case OpSet, OpDelete, OpIncr, OpDecr, OpCompareAndSwap, OpSetIfAbsent, OpCompareAndDelete:
+        return true
+    }
+    return false
+}
+
+// drain serves callers that happen to be blocked in a send when quit closes;
+// others see quit themselves. Loads that can no longer complete fail.
+func (cs *CacheServer) drain() {
+    for {
+        select {
+        case req := <-cs.requests:
+            cs.handle(req)
+        default:
+            for key, waiters := range cs.loading {
+                for _, waiter := range waiters {
+                    waiter <- CacheResponse{Err: ErrCacheClosed}
+                }
+                delete(cs.loading, key)
+            }
+            return
+        }
+    }
+}
+
+// apply executes one request. Only the run goroutine may call it. reply is
+// false when the response is sent later, e.g. to a request waiting on a load.
+func (cs *CacheServer) apply(req CacheRequest) (resp CacheResponse, reply bool) {
+    if cs.readOnly && mutates(req.Op) {
+        return CacheResponse{Err: ErrReadOnly}, true
+    }
+    if req.Op != OpKeys {
+        cs.expireIfDue(req.Key, time.Now())
+    }
+    
+    switch req.Op {
+    case OpGet:
+        value, exists := cs.cache[req.Key]
+        return CacheResponse{Value: value, Exists: exists}, true
+    
+    case OpSet:
+        cs.store(req.Key, req.Value, req.TTL)
+        return CacheResponse{Value: req.Value, Exists: true}, true
+    
+    case OpDelete:
+        value, exists := cs.cache[req.Key]
+        cs.remove(req.Key)
+        return CacheResponse{Value: value, Exists: exists}, true
+    
+    case OpExists:
+        _, exists := cs.cache[req.Key]
+        return CacheResponse{Exists: exists}, true
+    
+    case OpIncr, OpDecr:
+        delta := req.Delta
+        if req.Op == OpDecr {
+            delta = -delta
+        }
+        
+        current, exists := cs.cache[req.Key]
+        n, ok := toInt64(current)
+        if exists && !ok {
+            return CacheResponse{Value: current, Exists: true, Err: ErrNotInteger}, true
+        }
+        // Keeps the key's TTL
+        cs.cache[req.Key] = n + delta
+        return CacheResponse{Value: n + delta, Exists: true}, true
+    
+    case OpCompareAndSwap:
+        current, exists := cs.cache[req.Key]
+        if !exists {
+            return CacheResponse{Err: ErrKeyNotFound}, true
+        }
+        if !reflect.DeepEqual(current, req.Old) {
+            return CacheResponse{Value: current, Exists: false}, true
+        }
+        if req.TTL > 0 || req.ResetTTL {
+            cs.store(req.Key, req.Value, req.TTL)
         } else {
-            // Get operation
-            value, exists := cs.cache[req.Key]
-            req.Response <- CacheResponse{Value: value, Exists: exists}
+            cs.cache[req.Key] = req.Value
         }
+        return CacheResponse{Value: req.Value, Exists: true}, true
+    
+    case OpSetIfAbsent:
+        if current, exists := cs.cache[req.Key]; exists {
+            return CacheResponse{Value: current, Exists: false}, true
+        }
+        cs.store(req.Key, req.Value, req.TTL)
+        return CacheResponse{Value: req.Value, Exists: true}, true
+    
+    case OpCompareAndDelete:
+        current, exists := cs.cache[req.Key]
+        if !exists {
+            return CacheResponse{Err: ErrKeyNotFound}, true
+        }
+        if !reflect.DeepEqual(current, req.Old) {
+            return CacheResponse{Value: current, Exists: false}, true
+        }
+        cs.remove(req.Key)
+        return CacheResponse{Value: current, Exists: true}, true
+    
+    case OpKeys:
+        now := time.Now()
+        keys := make([]string, 0, len(cs.cache))
+        for key := range cs.cache {
+            if at, ok := cs.expiry[key]; ok && !now.Before(at) {
+                continue
+            }
+            if strings.HasPrefix(key, req.Key) {
+                keys = append(keys, key)
+            }
+        }
+        sort.Strings(keys)
+        return CacheResponse{Keys: keys}, true
+    
+    case OpLoad:
+        if value, exists := cs.cache[req.Key]; exists {
+            return CacheResponse{Value: value, Exists: true}, true
+        }
+        if waiters, pending := cs.loading[req.Key]; pending {
+            cs.loading[req.Key] = append(waiters, req.Response)
+            return CacheResponse{}, false
+        }
+        // A plain miss tells the caller it is the loader
+        cs.loading[req.Key] = nil
+        return CacheResponse{}, true
+    
+    case OpLoadDone:
+        resp := CacheResponse{Value: req.Value, Exists: req.Err == nil, Err: req.Err}
+        // A replica hands the loaded value to waiters without keeping it
+        if req.Err == nil && !cs.readOnly {
+            cs.store(req.Key, req.Value, req.TTL)
+        }
+        for _, waiter := range cs.loading[req.Key] {
+            waiter <- resp
+        }
+        delete(cs.loading, req.Key)
+        return resp, true
+    
+    case OpBatch:
+        results := make([]CacheResponse, len(req.Batch))
+        for i, op := range req.Batch {
+            switch op.Op {
+            case OpLoad, OpLoadDone, OpBatch, OpSnapshot, OpRestore, OpReplicate, OpObserve, OpSetReadOnly:
+                // These may answer later or recurse, neither fits one turn
+                results[i] = CacheResponse{Err: ErrNotBatchable}
+            default:
+                results[i], _ = cs.apply(op)
+            }
+        }
+        return CacheResponse{Batch: results}, true
+    
+    case OpSnapshot, OpRestore, OpReplicate, OpObserve, OpSetReadOnly:
+        return cs.applyReplication(req), true
+    
+    default:
+        return CacheResponse{Err: ErrUnknownOp}, true
     }
 }
 
-func (cs *CacheServer) Get(key string) (interface{}, bool) {
-    response := make(chan CacheResponse)
-    cs.requests <- CacheRequest{
-        Key:      key,
-        Response: response,
+func (cs *CacheServer) store(key string, value interface{}, ttl time.Duration) {
+    cs.cache[key] = value
+    if ttl <= 0 {
+        delete(cs.expiry, key)
+        return
     }
     
-    resp := <-response
-    return resp.Value, resp.Exists
+    at := time.Now().Add(ttl)
+    cs.expiry[key] = at
+    cs.timers.add(key, at)
+}
+
+func (cs *CacheServer) remove(key string) {
+    delete(cs.cache, key)
+    delete(cs.expiry, key)
 }
 
-func (cs *CacheServer) Set(key string, value interface{}) {
-    response := make(chan CacheResponse)
-    cs.requests <- CacheRequest{
-        Key:      key,
-        Value:    value,
-        Response: response,
+func (cs *CacheServer) expireIfDue(key string, now time.Time) {
+    if at, ok := cs.expiry[key]; ok && !now.Before(at) {
+        cs.remove(key)
     }
+}
+
+// expireDue drops every key whose deadline has passed. Heap entries left
+// behind by a later Set or Delete no longer match expiry and are skipped.
+func (cs *CacheServer) expireDue(now time.Time) {
+    for {
+        entry, ok := cs.timers.popDue(now)
+        if !ok {
+            return
+        }
+        if at, ok := cs.expiry[entry.key]; ok && at.Equal(entry.at) {
+            cs.remove(entry.key)
+        }
+    }
+}
+
+func toInt64(v interface{}) (int64, bool) {
+    switch n := v.(type) {
+    case nil:
+        return 0, true
+    case int:
+        return int64(n), true
+    case int64:
+        return n, true
+    case int32:
+        return int64(n), true
+    default:
+        return 0, false
+    }
+}
+
+func (cs *CacheServer) do(ctx context.Context, req CacheRequest) (CacheResponse, error) {
+    req.Response = make(chan CacheResponse, 1)
+    
+    select {
+    case cs.requests <- req:
+    case <-cs.quit:
+        return CacheResponse{}, ErrCacheClosed
+    case <-ctx.Done():
+        return CacheResponse{}, ctx.Err()
+    }
+    
+    select {
+    case resp := <-req.Response:
+        return resp, nil
+    case <-ctx.Done():
+        if req.Op == OpLoad {
+            // The actor may already have made this caller the loader
+            go cs.releaseAbandonedLoad(ctx, req)
+        }
+        return CacheResponse{}, ctx.Err()
+    }
+}
+
+// releaseAbandonedLoad waits for the reply to an OpLoad whose caller gave
+// up. If it made the caller the loader, the load is reported as failed so
+// the key is not stuck in loading and waiters get ctx's error.
+func (cs *CacheServer) releaseAbandonedLoad(ctx context.Context, req CacheRequest) {
+    resp := <-req.Response
+    if resp.Exists || resp.Err != nil {
+        return
+    }
+    cs.do(context.WithoutCancel(ctx), CacheRequest{Op: OpLoadDone, Key: req.Key, Err: ctx.Err()})
+}
+
+// Close stops accepting requests and stops the actor. requests is
+// unbuffered, so nothing is queued: a call racing with Close is either
+// served or gets ErrCacheClosed, never left waiting. Close returns ctx's
+// error if stopping takes longer than ctx allows.
+func (cs *CacheServer) Close(ctx context.Context) error {
+    cs.closeOnce.Do(func() {
+        close(cs.quit)
+    })
     
-    <-response // Wait for confirmation
+    select {
+    case <-cs.done:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+func (cs *CacheServer) Get(ctx context.Context, key string) (interface{}, bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpGet, Key: key})
+    return resp.Value, resp.Exists, err
+}
+
+func (cs *CacheServer) Set(ctx context.Context, key string, value interface{}) error {
+    return cs.SetWithTTL(ctx, key, value, 0)
+}
+
+// SetWithTTL stores value until ttl elapses
+func (cs *CacheServer) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpSet, Key: key, Value: value, TTL: ttl})
+    if err != nil {
+        return err
+    }
+    return resp.Err
+}
+
+// GetOrLoad returns the cached value or runs load to fill it. Concurrent
+// misses for the same key share a single load and all get its result.
+func (cs *CacheServer) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func() (interface{}, error)) (interface{}, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpLoad, Key: key})
+    if err != nil {
+        return nil, err
+    }
+    if resp.Exists || resp.Err != nil {
+        return resp.Value, resp.Err
+    }
+    
+    value, err := runLoader(load)
+    
+    // Report the result even if ctx is done, otherwise waiters would hang
+    resp, doneErr := cs.do(context.WithoutCancel(ctx), CacheRequest{Op: OpLoadDone, Key: key, Value: value, TTL: ttl, Err: err})
+    if err != nil {
+        return nil, err
+    }
+    if doneErr != nil {
+        return value, nil
+    }
+    return resp.Value, resp.Err
+}
+
+// runLoader turns a panicking loader into an error so waiters are released
+func runLoader(load func() (interface{}, error)) (value interface{}, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("loader panicked: %v", r)
+        }
+    }()
+    return load()
+}
+
+// Delete removes key and reports whether it was present
+func (cs *CacheServer) Delete(ctx context.Context, key string) (bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpDelete, Key: key})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+func (cs *CacheServer) Exists(ctx context.Context, key string) (bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpExists, Key: key})
+    return resp.Exists, err
+}
+
+// Incr adds delta to an integer value, treating a missing key as 0
+func (cs *CacheServer) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+    return cs.addInt(ctx, OpIncr, key, delta)
+}
+
+func (cs *CacheServer) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+    return cs.addInt(ctx, OpDecr, key, delta)
+}
+
+func (cs *CacheServer) addInt(ctx context.Context, op CacheOp, key string, delta int64) (int64, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: op, Key: key, Delta: delta})
+    if err != nil {
+        return 0, err
+    }
+    if resp.Err != nil {
+        return 0, resp.Err
+    }
+    return resp.Value.(int64), nil
+}
+
+// CompareAndSwap sets key to new only if its current value equals old
+func (cs *CacheServer) CompareAndSwap(ctx context.Context, key string, old, new interface{}) (bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpCompareAndSwap, Key: key, Old: old, Value: new})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+// SetIfAbsent stores value only if key is missing and reports whether it did
+func (cs *CacheServer) SetIfAbsent(ctx context.Context, key string, value interface{}, ttl time.Duration) (bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpSetIfAbsent, Key: key, Value: value, TTL: ttl})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+// CompareAndDelete removes key only if its current value equals old
+func (cs *CacheServer) CompareAndDelete(ctx context.Context, key string, old interface{}) (bool, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpCompareAndDelete, Key: key, Old: old})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+// Batch applies ops in order in a single round trip to the actor. No other
+// request is interleaved, so the batch is atomic with respect to them.
+func (cs *CacheServer) Batch(ctx context.Context, ops []CacheRequest) ([]CacheResponse, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpBatch, Batch: ops})
+    return resp.Batch, err
+}
+
+// Keys returns the sorted keys starting with prefix, "" for all keys
+func (cs *CacheServer) Keys(ctx context.Context, prefix string) ([]string, error) {
+    resp, err := cs.do(ctx, CacheRequest{Op: OpKeys, Key: prefix})
+    return resp.Keys, err
 }
 
 func (cs *CacheServer) userHandler(w http.ResponseWriter, r *http.Request) {
     userID := r.URL.Query().Get("id")
     
-    user, exists := cs.Get(userID)
-    if !exists {
+    user, err := cs.GetOrLoad(r.Context(), userID, 5*time.Minute, func() (interface{}, error) {
         // Simulate database lookup
-        user = map[string]interface{}{
+        return map[string]interface{}{
             "id":    userID,
             "name":  "User " + userID,
             "email": userID + "@example.com",
-        }
-        cs.Set(userID, user)
+        }, nil
+    })
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
     }
     
     json.NewEncoder(w).Encode(user)
@@ -0,0 +1,83 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "runtime"
+    "strconv"
+    "sync"
+    "testing"
+)
+
+// mutexCache has the same locking shape as UserCache in locks/mem.go: one
+// RWMutex around a map. That package is its own main, so it's mirrored here.
+type mutexCache struct {
+    mu    sync.RWMutex
+    items map[string]interface{}
+}
+
+func (c *mutexCache) Get(ctx context.Context, key string) (interface{}, bool, error) {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    
+    value, exists := c.items[key]
+    return value, exists, nil
+}
+
+func (c *mutexCache) Set(ctx context.Context, key string, value interface{}) error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.items[key] = value
+    return nil
+}
+
+type benchCache interface {
+    Get(ctx context.Context, key string) (interface{}, bool, error)
+    Set(ctx context.Context, key string, value interface{}) error
+}
+
+// benchmarkCache runs a parallel 90% read / 10% write mix over 1024 keys
+func benchmarkCache(cache benchCache) testing.BenchmarkResult {
+    ctx := context.Background()
+    keys := make([]string, 1024)
+    for i := range keys {
+        keys[i] = "user:" + strconv.Itoa(i)
+        cache.Set(ctx, keys[i], i)
+    }
+    
+    return testing.Benchmark(func(b *testing.B) {
+        b.RunParallel(func(pb *testing.PB) {
+            i := 0
+            for pb.Next() {
+                key := keys[i%len(keys)]
+                if i%10 == 0 {
+                    cache.Set(ctx, key, i)
+                } else {
+                    cache.Get(ctx, key)
+                }
+                i++
+            }
+        })
+    })
+}
+
+// Usage - compare the cache designs under the same parallel workload
+func main() {
+    shards := runtime.GOMAXPROCS(0)
+    
+    caches := []struct {
+        name  string
+        cache benchCache
+    }{
+        {"single actor", NewCacheServer()},
+        {fmt.Sprintf("sharded actor (%d)", shards), NewShardedCacheServer(shards)},
+        {"pipelined actor", NewCachePipeliner(NewCacheServer(), 64)},
+        {"RWMutex map", &mutexCache{items: make(map[string]interface{})}},
+    }
+    
+    for _, c := range caches {
+        result := benchmarkCache(c.cache)
+        fmt.Printf("%-22s %s\n", c.name, result)
+    }
+}
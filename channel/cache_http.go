@@ -0,0 +1,330 @@
+package main
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const maxResourceSize = 10 << 20
+
+// resource is how the HTTP API stores a PUT body in the cache
+type resource struct {
+    Data        []byte
+    ContentType string
+    ETag        string
+    Modified    time.Time
+}
+
+// CacheAPI exposes a CacheServer as HTTP resources under /cache/{key}:
+//
+//    GET/HEAD /cache/{key}        read, honours If-None-Match
+//    PUT      /cache/{key}        write, honours If-Match / If-None-Match, Cache-TTL
+//    DELETE   /cache/{key}        delete, honours If-Match
+//    GET      /cache?prefix=user: list keys
+//
+// Every PUT sets the expiry from Cache-TTL; without it the value never
+// expires, whether or not If-Match was given.
+type CacheAPI struct {
+    cs *CacheServer
+}
+
+func NewCacheAPI(cs *CacheServer) *CacheAPI {
+    return &CacheAPI{cs: cs}
+}
+
+func (api *CacheAPI) Register(mux *http.ServeMux) {
+    mux.HandleFunc("GET /cache", api.list)
+    mux.HandleFunc("GET /cache/{$}", api.list)
+    mux.HandleFunc("GET /cache/{key...}", api.get)
+    mux.HandleFunc("PUT /cache/{key...}", api.put)
+    mux.HandleFunc("DELETE /cache/{key...}", api.delete)
+}
+
+// asResource presents any cached value as a resource. Values stored through
+// the Go API, like userHandler's users, are served as JSON.
+func asResource(value interface{}) (resource, error) {
+    if res, ok := value.(resource); ok {
+        return res, nil
+    }
+    
+    data, err := json.Marshal(value)
+    if err != nil {
+        return resource{}, err
+    }
+    return resource{Data: data, ContentType: "application/json", ETag: computeETag(data)}, nil
+}
+
+func computeETag(data []byte) string {
+    sum := sha256.Sum256(data)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches implements the weak comparison used by If-None-Match
+func etagMatches(header, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+            return true
+        }
+    }
+    return false
+}
+
+// etagMatchesStrong implements the strong comparison If-Match requires:
+// weak tags on either side never match
+func etagMatchesStrong(header, etag string) bool {
+    if strings.HasPrefix(etag, "W/") {
+        return false
+    }
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || candidate == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// parseTTL accepts seconds ("30") or a Go duration ("1m30s")
+func parseTTL(header string) (time.Duration, error) {
+    if header == "" {
+        return 0, nil
+    }
+    ttl, err := time.ParseDuration(header)
+    if secs, atoiErr := strconv.Atoi(header); atoiErr == nil {
+        ttl, err = time.Duration(secs)*time.Second, nil
+    }
+    if err == nil && ttl < 0 {
+        err = errors.New("negative TTL")
+    }
+    return ttl, err
+}
+
+func (api *CacheAPI) list(w http.ResponseWriter, r *http.Request) {
+    keys, err := api.cs.Keys(r.Context(), r.URL.Query().Get("prefix"))
+    if err != nil {
+        writeCacheError(w, err)
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func (api *CacheAPI) get(w http.ResponseWriter, r *http.Request) {
+    value, exists, err := api.cs.Get(r.Context(), r.PathValue("key"))
+    if err != nil {
+        writeCacheError(w, err)
+        return
+    }
+    if !exists {
+        http.NotFound(w, r)
+        return
+    }
+    
+    res, err := asResource(value)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    
+    w.Header().Set("ETag", res.ETag)
+    if !res.Modified.IsZero() {
+        w.Header().Set("Last-Modified", res.Modified.UTC().Format(http.TimeFormat))
+    }
+    if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, res.ETag) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    
+    w.Header().Set("Content-Type", res.ContentType)
+    w.Header().Set("Content-Length", strconv.Itoa(len(res.Data)))
+    w.Write(res.Data) // dropped by net/http for HEAD
+}
+
+func (api *CacheAPI) put(w http.ResponseWriter, r *http.Request) {
+    key := r.PathValue("key")
+    
+    ttl, err := parseTTL(r.Header.Get("Cache-TTL"))
+    if err != nil {
+        http.Error(w, "invalid Cache-TTL: "+err.Error(), http.StatusBadRequest)
+        return
+    }
+    
+    data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxResourceSize))
+    if err != nil {
+        status := http.StatusBadRequest
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            status = http.StatusRequestEntityTooLarge
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+    
+    contentType := r.Header.Get("Content-Type")
+    if contentType == "" {
+        contentType = "application/octet-stream"
+    }
+    if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType == "application/json" {
+        var compacted bytes.Buffer
+        if err := json.Compact(&compacted, data); err != nil {
+            http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        data = compacted.Bytes()
+    }
+    
+    res := resource{
+        Data:        data,
+        ContentType: contentType,
+        ETag:        computeETag(data),
+        Modified:    time.Now(),
+    }
+    
+    var applied bool
+    switch {
+    case r.Header.Get("If-None-Match") != "":
+        applied, err = api.ifNoneMatch(r, key, res, ttl)
+    
+    case r.Header.Get("If-Match") != "":
+        applied, err = api.ifMatch(r, key, func(current interface{}) (bool, error) {
+            return api.swap(r, key, current, res, ttl)
+        })
+    
+    default:
+        applied, err = true, api.cs.SetWithTTL(r.Context(), key, res, ttl)
+    }
+    
+    if err != nil {
+        writeCacheError(w, err)
+        return
+    }
+    if !applied {
+        w.WriteHeader(http.StatusPreconditionFailed)
+        return
+    }
+    
+    w.Header().Set("ETag", res.ETag)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *CacheAPI) delete(w http.ResponseWriter, r *http.Request) {
+    key := r.PathValue("key")
+    
+    if r.Header.Get("If-Match") != "" {
+        applied, err := api.ifMatch(r, key, func(current interface{}) (bool, error) {
+            return api.cs.CompareAndDelete(r.Context(), key, current)
+        })
+        if err != nil {
+            writeCacheError(w, err)
+            return
+        }
+        if !applied {
+            w.WriteHeader(http.StatusPreconditionFailed)
+            return
+        }
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    
+    existed, err := api.cs.Delete(r.Context(), key)
+    if err != nil {
+        writeCacheError(w, err)
+        return
+    }
+    if !existed {
+        http.NotFound(w, r)
+        return
+    }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// ifMatch checks If-Match against the current value and, if it matches,
+// calls apply with that value so the update only lands if nothing changed
+// in between. A missing key never matches.
+func (api *CacheAPI) ifMatch(r *http.Request, key string, apply func(current interface{}) (bool, error)) (bool, error) {
+    current, exists, err := api.cs.Get(r.Context(), key)
+    if err != nil || !exists {
+        return false, err
+    }
+    
+    res, err := asResource(current)
+    if err != nil {
+        return false, err
+    }
+    if !etagMatchesStrong(r.Header.Get("If-Match"), res.ETag) {
+        return false, nil
+    }
+    
+    applied, err := apply(current)
+    if errors.Is(err, ErrKeyNotFound) {
+        return false, nil
+    }
+    return applied, err
+}
+
+// ifNoneMatch stores res unless the current value's ETag is listed in
+// If-None-Match, "*" matching any value. A missing key is filled with
+// SetIfAbsent and an existing one swapped against the value that was
+// checked; if either loses a race the check runs again.
+func (api *CacheAPI) ifNoneMatch(r *http.Request, key string, res resource, ttl time.Duration) (bool, error) {
+    for {
+        current, exists, err := api.cs.Get(r.Context(), key)
+        if err != nil {
+            return false, err
+        }
+        
+        if !exists {
+            applied, err := api.cs.SetIfAbsent(r.Context(), key, res, ttl)
+            if err != nil || applied {
+                return applied, err
+            }
+            continue
+        }
+        
+        currentRes, err := asResource(current)
+        if err != nil {
+            return false, err
+        }
+        if etagMatches(r.Header.Get("If-None-Match"), currentRes.ETag) {
+            return false, nil
+        }
+        
+        applied, err := api.swap(r, key, current, res, ttl)
+        if errors.Is(err, ErrKeyNotFound) || (err == nil && !applied) {
+            continue
+        }
+        return applied, err
+    }
+}
+
+// swap replaces current with res. Like a plain PUT, the new Cache-TTL
+// replaces the old expiry.
+func (api *CacheAPI) swap(r *http.Request, key string, current interface{}, res resource, ttl time.Duration) (bool, error) {
+    resp, err := api.cs.do(r.Context(), CacheRequest{Op: OpCompareAndSwap, Key: key, Old: current, Value: res, TTL: ttl, ResetTTL: true})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+func writeCacheError(w http.ResponseWriter, err error) {
+    status := http.StatusInternalServerError
+    switch {
+    case errors.Is(err, ErrCacheClosed):
+        status = http.StatusServiceUnavailable
+    case errors.Is(err, ErrReadOnly):
+        status = http.StatusMethodNotAllowed
+    }
+    http.Error(w, err.Error(), status)
+}
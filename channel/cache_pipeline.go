@@ -0,0 +1,155 @@
+package main
+
+import (
+    "context"
+    "sync"
+)
+
+type pipelineResult struct {
+    resp CacheResponse
+    err  error
+}
+
+type pipelineCall struct {
+    req    CacheRequest
+    result chan pipelineResult
+}
+
+// CachePipeliner batches concurrent calls automatically. While one batch is
+// with the actor, new calls queue up and go out together in the next one.
+type CachePipeliner struct {
+    cs         *CacheServer
+    calls      chan pipelineCall
+    maxBatch   int
+    resultPool sync.Pool
+    
+    // mu is held for reading while sending on calls, so Close can close it
+    mu     sync.RWMutex
+    closed bool
+    done   chan struct{}
+}
+
+func NewCachePipeliner(cs *CacheServer, maxBatch int) *CachePipeliner {
+    if maxBatch <= 0 {
+        maxBatch = 64
+    }
+    
+    p := &CachePipeliner{
+        cs:       cs,
+        calls:    make(chan pipelineCall, maxBatch),
+        maxBatch: maxBatch,
+        done:     make(chan struct{}),
+        resultPool: sync.Pool{
+            New: func() interface{} { return make(chan pipelineResult, 1) },
+        },
+    }
+    
+    go p.run()
+    
+    return p
+}
+
+func (p *CachePipeliner) run() {
+    defer close(p.done)
+    
+    batch := make([]pipelineCall, 0, p.maxBatch)
+    ops := make([]CacheRequest, 0, p.maxBatch)
+    
+    for call := range p.calls {
+        batch = append(batch[:0], call)
+        
+        // Take whatever else is already waiting, without blocking
+    collect:
+        for len(batch) < p.maxBatch {
+            select {
+            case call, ok := <-p.calls:
+                if !ok {
+                    break collect
+                }
+                batch = append(batch, call)
+            default:
+                break collect
+            }
+        }
+        
+        ops = ops[:0]
+        for _, c := range batch {
+            ops = append(ops, c.req)
+        }
+        
+        // The batch is shared by many callers, so no single caller's
+        // context applies; callers give up on their own contexts instead.
+        responses, err := p.cs.Batch(context.Background(), ops)
+        for i, c := range batch {
+            if err != nil {
+                c.result <- pipelineResult{err: err}
+                continue
+            }
+            c.result <- pipelineResult{resp: responses[i]}
+        }
+    }
+}
+
+// Do queues req for the next batch and waits for its response. A request
+// that was already queued may still be applied after ctx is done.
+func (p *CachePipeliner) Do(ctx context.Context, req CacheRequest) (CacheResponse, error) {
+    result := p.resultPool.Get().(chan pipelineResult)
+    
+    p.mu.RLock()
+    if p.closed {
+        p.mu.RUnlock()
+        p.resultPool.Put(result)
+        return CacheResponse{}, ErrCacheClosed
+    }
+    select {
+    case p.calls <- pipelineCall{req: req, result: result}:
+        p.mu.RUnlock()
+    case <-ctx.Done():
+        p.mu.RUnlock()
+        p.resultPool.Put(result)
+        return CacheResponse{}, ctx.Err()
+    }
+    
+    select {
+    case r := <-result:
+        p.resultPool.Put(result)
+        return r.resp, r.err
+    case <-ctx.Done():
+        // result will still be written to, so it can't go back in the pool
+        return CacheResponse{}, ctx.Err()
+    }
+}
+
+func (p *CachePipeliner) Get(ctx context.Context, key string) (interface{}, bool, error) {
+    resp, err := p.Do(ctx, CacheRequest{Op: OpGet, Key: key})
+    return resp.Value, resp.Exists, err
+}
+
+func (p *CachePipeliner) Set(ctx context.Context, key string, value interface{}) error {
+    resp, err := p.Do(ctx, CacheRequest{Op: OpSet, Key: key, Value: value})
+    if err != nil {
+        return err
+    }
+    return resp.Err
+}
+
+func (p *CachePipeliner) Delete(ctx context.Context, key string) (bool, error) {
+    resp, err := p.Do(ctx, CacheRequest{Op: OpDelete, Key: key})
+    if err != nil {
+        return false, err
+    }
+    return resp.Exists, resp.Err
+}
+
+// Close stops the pipeliner once the calls already queued were sent.
+// Calls made after Close return ErrCacheClosed.
+func (p *CachePipeliner) Close() {
+    p.mu.Lock()
+    if !p.closed {
+        p.closed = true
+        close(p.calls)
+    }
+    p.mu.Unlock()
+    
+    <-p.done
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/gob"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// Values travel to replicas as interface{}, so gob needs their types
+func init() {
+    gob.Register(resource{})
+    gob.Register(map[string]interface{}{})
+    gob.Register([]interface{}{})
+}
+
+// Mutation is the state of one key after a change on the primary. Replicas
+// apply it as is, so re-applying or skipping ahead to a snapshot is safe.
+type Mutation struct {
+    Seq      uint64
+    Key      string
+    Deleted  bool
+    Value    interface{}
+    ExpireAt time.Time // zero if the key never expires
+}
+
+type CacheSnapshot struct {
+    Seq     uint64
+    Entries []Mutation
+}
+
+// publish hands every change made by req to the observer, in actor order
+func (cs *CacheServer) publish(req CacheRequest, resp CacheResponse) {
+    if cs.observer == nil {
+        return
+    }
+    
+    if req.Op == OpBatch {
+        for i, op := range req.Batch {
+            if i < len(resp.Batch) {
+                cs.publish(op, resp.Batch[i])
+            }
+        }
+        return
+    }
+    
+    if !changed(req.Op, resp) {
+        return
+    }
+    cs.seq++
+    cs.observer(cs.mutationFor(req.Key))
+}
+
+func changed(op CacheOp, resp CacheResponse) bool {
+    switch op {
+    case OpSet, OpLoadDone, OpIncr, OpDecr:
+        return resp.Err == nil
+    case OpDelete:
+        return resp.Exists
+    case OpCompareAndSwap, OpSetIfAbsent, OpCompareAndDelete:
+        return resp.Err == nil && resp.Exists
+    }
+    return false
+}
+
+func (cs *CacheServer) mutationFor(key string) Mutation {
+    value, exists := cs.cache[key]
+    if !exists {
+        return Mutation{Seq: cs.seq, Key: key, Deleted: true}
+    }
+    return Mutation{Seq: cs.seq, Key: key, Value: value, ExpireAt: cs.expiry[key]}
+}
+
+// storeUntil is store with an absolute deadline, as sent by a primary
+func (cs *CacheServer) storeUntil(key string, value interface{}, at time.Time) {
+    if at.IsZero() {
+        cs.store(key, value, 0)
+        return
+    }
+    if !time.Now().Before(at) {
+        cs.remove(key)
+        return
+    }
+    
+    cs.cache[key] = value
+    cs.expiry[key] = at
+    cs.timers.add(key, at)
+}
+
+func (cs *CacheServer) applyReplication(req CacheRequest) CacheResponse {
+    switch req.Op {
+    case OpSnapshot:
+        now := time.Now()
+        snap := CacheSnapshot{Seq: cs.seq, Entries: make([]Mutation, 0, len(cs.cache))}
+        for key, value := range cs.cache {
+            at := cs.expiry[key]
+            if !at.IsZero() && !now.Before(at) {
+                continue
+            }
+            snap.Entries = append(snap.Entries, Mutation{Seq: cs.seq, Key: key, Value: value, ExpireAt: at})
+        }
+        return CacheResponse{Value: snap, Exists: true}
+    
+    case OpRestore:
+        snap := req.Value.(CacheSnapshot)
+        cs.cache = make(map[string]interface{}, len(snap.Entries))
+        cs.expiry = make(map[string]time.Time)
+        cs.timers = nil
+        for _, entry := range snap.Entries {
+            cs.storeUntil(entry.Key, entry.Value, entry.ExpireAt)
+        }
+        cs.seq = snap.Seq
+        return CacheResponse{Value: cs.seq, Exists: true}
+    
+    case OpReplicate:
+        m := req.Value.(Mutation)
+        if m.Seq <= cs.seq {
+            return CacheResponse{Value: cs.seq}
+        }
+        if m.Deleted {
+            cs.remove(m.Key)
+        } else {
+            cs.storeUntil(m.Key, m.Value, m.ExpireAt)
+        }
+        cs.seq = m.Seq
+        return CacheResponse{Value: cs.seq, Exists: true}
+    
+    case OpObserve:
+        cs.observer, _ = req.Value.(func(Mutation))
+        return CacheResponse{Value: cs.seq, Exists: true}
+    
+    case OpSetReadOnly:
+        cs.readOnly = req.Value.(bool)
+        return CacheResponse{Exists: true}
+    }
+    
+    return CacheResponse{Err: ErrUnknownOp}
+}
+
+// Wire protocol: the replica sends a replHello, then the primary streams
+// replMessages, all gob encoded over one TCP connection.
+type replHello struct {
+    Epoch   string // primary the replica last synced from
+    LastSeq uint64
+}
+
+type replMessage struct {
+    Epoch     string
+    Snapshot  *CacheSnapshot
+    Mutation  *Mutation
+    Heartbeat *replHeartbeat
+}
+
+type replHeartbeat struct {
+    Seq    uint64
+    SentAt time.Time
+}
+
+// ReplicationPrimary streams every mutation of a CacheServer to replicas.
+// Recent mutations are kept in a backlog so a replica that reconnects can
+// catch up from the tail instead of a full snapshot.
+type ReplicationPrimary struct {
+    cs          *CacheServer
+    listener    net.Listener
+    epoch       string
+    backlogSize int
+    
+    mu       sync.Mutex
+    seq      uint64
+    backlog  []Mutation
+    replicas map[*replicaLink]struct{}
+}
+
+type replicaLink struct {
+    addr    string
+    conn    net.Conn
+    queue   chan Mutation
+    sentSeq uint64 // guarded by ReplicationPrimary.mu
+    closed  chan struct{}
+    once    sync.Once
+}
+
+func (l *replicaLink) close() {
+    l.once.Do(func() {
+        close(l.closed)
+        l.conn.Close()
+    })
+}
+
+type ReplicaLinkStatus struct {
+    Addr    string `json:"addr"`
+    SentSeq uint64 `json:"sent_seq"`
+    Queued  int    `json:"queued"`
+}
+
+type PrimaryStatus struct {
+    Epoch    string              `json:"epoch"`
+    Seq      uint64              `json:"seq"`
+    Replicas []ReplicaLinkStatus `json:"replicas"`
+}
+
+func StartPrimary(ctx context.Context, cs *CacheServer, addr string, backlogSize int) (*ReplicationPrimary, error) {
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return startPrimaryOn(ctx, cs, listener, backlogSize)
+}
+
+// startPrimaryOn serves replicas on listener, closing it on error
+func startPrimaryOn(ctx context.Context, cs *CacheServer, listener net.Listener, backlogSize int) (*ReplicationPrimary, error) {
+    if backlogSize <= 0 {
+        backlogSize = 10000
+    }
+    
+    epoch := make([]byte, 8)
+    rand.Read(epoch)
+    
+    p := &ReplicationPrimary{
+        cs:          cs,
+        listener:    listener,
+        epoch:       hex.EncodeToString(epoch),
+        backlogSize: backlogSize,
+        replicas:    make(map[*replicaLink]struct{}),
+    }
+    
+    resp, err := cs.do(ctx, CacheRequest{Op: OpObserve, Value: p.observe})
+    if err != nil {
+        listener.Close()
+        return nil, err
+    }
+    p.mu.Lock()
+    if seq := resp.Value.(uint64); seq > p.seq {
+        p.seq = seq
+    }
+    p.mu.Unlock()
+    
+    go p.accept()
+    
+    return p, nil
+}
+
+func (p *ReplicationPrimary) Addr() net.Addr {
+    return p.listener.Addr()
+}
+
+// observe runs on the cache's run goroutine, so it must never block
+func (p *ReplicationPrimary) observe(m Mutation) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    p.seq = m.Seq
+    p.backlog = append(p.backlog, m)
+    if len(p.backlog) > p.backlogSize {
+        p.backlog = append(p.backlog[:0:0], p.backlog[len(p.backlog)-p.backlogSize:]...)
+    }
+    
+    for link := range p.replicas {
+        select {
+        case link.queue <- m:
+        default:
+            // Too far behind, it will resync from a snapshot
+            log.Printf("Replica %s fell behind, disconnecting", link.addr)
+            delete(p.replicas, link)
+            link.close()
+        }
+    }
+}
+
+func (p *ReplicationPrimary) accept() {
+    for {
+        conn, err := p.listener.Accept()
+        if err != nil {
+            return
+        }
+        go p.serve(conn)
+    }
+}
+
+func (p *ReplicationPrimary) serve(conn net.Conn) {
+    link := &replicaLink{
+        addr:   conn.RemoteAddr().String(),
+        conn:   conn,
+        queue:  make(chan Mutation, 4096),
+        closed: make(chan struct{}),
+    }
+    defer func() {
+        p.mu.Lock()
+        delete(p.replicas, link)
+        p.mu.Unlock()
+        link.close()
+    }()
+    
+    enc := gob.NewEncoder(conn)
+    dec := gob.NewDecoder(conn)
+    
+    var hello replHello
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    if err := dec.Decode(&hello); err != nil {
+        log.Printf("Replica %s handshake failed: %v", link.addr, err)
+        return
+    }
+    conn.SetReadDeadline(time.Time{})
+    
+    // Register before taking the snapshot so no mutation falls in between
+    p.mu.Lock()
+    tail, fromBacklog := p.tailSinceLocked(hello)
+    p.replicas[link] = struct{}{}
+    p.mu.Unlock()
+    
+    sentSeq := hello.LastSeq
+    if fromBacklog {
+        for i := range tail {
+            if err := p.sendMutation(link, enc, &tail[i]); err != nil {
+                return
+            }
+            sentSeq = tail[i].Seq
+        }
+    } else {
+        resp, err := p.cs.do(context.Background(), CacheRequest{Op: OpSnapshot})
+        if err != nil {
+            return
+        }
+        snap := resp.Value.(CacheSnapshot)
+        if err := p.sendSnapshot(link, enc, &snap); err != nil {
+            return
+        }
+        sentSeq = snap.Seq
+    }
+    log.Printf("Replica %s synced to seq %d (backlog: %v)", link.addr, sentSeq, fromBacklog)
+    
+    heartbeat := time.NewTicker(time.Second)
+    defer heartbeat.Stop()
+    
+    for {
+        var err error
+        select {
+        case m := <-link.queue:
+            if m.Seq <= sentSeq {
+                continue
+            }
+            err = p.sendMutation(link, enc, &m)
+            sentSeq = m.Seq
+        case <-heartbeat.C:
+            err = enc.Encode(replMessage{Epoch: p.epoch, Heartbeat: &replHeartbeat{Seq: p.currentSeq(), SentAt: time.Now()}})
+        case <-link.closed:
+            return
+        }
+        
+        if err != nil {
+            log.Printf("Replica %s disconnected: %v", link.addr, err)
+            return
+        }
+        
+        p.mu.Lock()
+        link.sentSeq = sentSeq
+        p.mu.Unlock()
+    }
+}
+
+// encodeCheck tries m on a throwaway encoder. A failed Encode may already
+// have written type descriptors, which would leave the replica unable to
+// decode the rest of the stream, so nothing reaches the link unchecked.
+func encodeCheck(m *Mutation) error {
+    return gob.NewEncoder(io.Discard).Encode(m)
+}
+
+// sendMutation sends m, or a deletion of its key if its value can't be
+// encoded. Resyncing would fail on the same value forever, and a missing
+// key is safer on a replica than a stale one.
+func (p *ReplicationPrimary) sendMutation(link *replicaLink, enc *gob.Encoder, m *Mutation) error {
+    if err := encodeCheck(m); err != nil {
+        log.Printf("Replica %s: not replicating %q, %T can't be encoded: %v", link.addr, m.Key, m.Value, err)
+        m = &Mutation{Seq: m.Seq, Key: m.Key, Deleted: true}
+    }
+    return enc.Encode(replMessage{Epoch: p.epoch, Mutation: m})
+}
+
+// sendSnapshot sends snap, leaving out entries whose values can't be encoded
+func (p *ReplicationPrimary) sendSnapshot(link *replicaLink, enc *gob.Encoder, snap *CacheSnapshot) error {
+    encodable := CacheSnapshot{Seq: snap.Seq, Entries: make([]Mutation, 0, len(snap.Entries))}
+    for i := range snap.Entries {
+        entry := &snap.Entries[i]
+        if err := encodeCheck(entry); err != nil {
+            log.Printf("Replica %s: not replicating %q, %T can't be encoded: %v", link.addr, entry.Key, entry.Value, err)
+            continue
+        }
+        encodable.Entries = append(encodable.Entries, *entry)
+    }
+    return enc.Encode(replMessage{Epoch: p.epoch, Snapshot: &encodable})
+}
+
+// tailSinceLocked returns the backlog after hello.LastSeq, if it still
+// covers it and the replica followed this primary
+func (p *ReplicationPrimary) tailSinceLocked(hello replHello) ([]Mutation, bool) {
+    if hello.Epoch != p.epoch || hello.LastSeq > p.seq {
+        return nil, false
+    }
+    if hello.LastSeq == p.seq {
+        return nil, true
+    }
+    if len(p.backlog) == 0 || p.backlog[0].Seq > hello.LastSeq+1 {
+        return nil, false
+    }
+    
+    var tail []Mutation
+    for _, m := range p.backlog {
+        if m.Seq > hello.LastSeq {
+            tail = append(tail, m)
+        }
+    }
+    return tail, true
+}
+
+func (p *ReplicationPrimary) currentSeq() uint64 {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    return p.seq
+}
+
+func (p *ReplicationPrimary) Status() PrimaryStatus {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    
+    status := PrimaryStatus{Epoch: p.epoch, Seq: p.seq}
+    for link := range p.replicas {
+        status.Replicas = append(status.Replicas, ReplicaLinkStatus{
+            Addr:    link.addr,
+            SentSeq: link.sentSeq,
+            Queued:  len(link.queue),
+        })
+    }
+    return status
+}
+
+// Close stops serving replicas and detaches from the cache
+func (p *ReplicationPrimary) Close(ctx context.Context) error {
+    err := p.listener.Close()
+    
+    p.mu.Lock()
+    for link := range p.replicas {
+        link.close()
+    }
+    p.mu.Unlock()
+    
+    _, detachErr := p.cs.do(ctx, CacheRequest{Op: OpObserve})
+    return errors.Join(err, detachErr)
+}
+
+// ReplicationReplica keeps a read-only CacheServer in sync with a primary
+type ReplicationReplica struct {
+    cs          *CacheServer
+    primaryAddr string
+    cancel      context.CancelFunc
+    done        chan struct{}
+    
+    mu     sync.Mutex
+    epoch  string
+    status ReplicaStatus
+}
+
+type ReplicaStatus struct {
+    PrimaryAddr    string        `json:"primary_addr"`
+    Connected      bool          `json:"connected"`
+    AppliedSeq     uint64        `json:"applied_seq"`
+    PrimarySeq     uint64        `json:"primary_seq"`
+    LagOps         uint64        `json:"lag_ops"`
+    LastContact    time.Time     `json:"last_contact"`
+    HeartbeatDelay time.Duration `json:"heartbeat_delay_ns"` // includes clock skew
+}
+
+// StartReplica turns cs into a read-only replica of the primary at addr
+func StartReplica(ctx context.Context, cs *CacheServer, primaryAddr string) (*ReplicationReplica, error) {
+    if _, err := cs.do(ctx, CacheRequest{Op: OpSetReadOnly, Value: true}); err != nil {
+        return nil, err
+    }
+    
+    r := &ReplicationReplica{
+        cs:          cs,
+        primaryAddr: primaryAddr,
+        status:      ReplicaStatus{PrimaryAddr: primaryAddr},
+    }
+    r.start()
+    
+    return r, nil
+}
+
+// start follows the primary until Stop
+func (r *ReplicationReplica) start() {
+    runCtx, cancel := context.WithCancel(context.Background())
+    r.cancel = cancel
+    r.done = make(chan struct{})
+    go r.run(runCtx)
+}
+
+func (r *ReplicationReplica) run(ctx context.Context) {
+    defer close(r.done)
+    
+    backoff := 500 * time.Millisecond
+    for {
+        synced, err := r.stream(ctx)
+        if ctx.Err() != nil {
+            return
+        }
+        log.Printf("Replication from %s stopped: %v", r.primaryAddr, err)
+        
+        if synced {
+            backoff = 500 * time.Millisecond
+        }
+        select {
+        case <-time.After(backoff):
+        case <-ctx.Done():
+            return
+        }
+        backoff = min(backoff*2, 30*time.Second)
+    }
+}
+
+// stream follows the primary until the connection fails. synced reports
+// whether it got as far as a snapshot or tail.
+func (r *ReplicationReplica) stream(ctx context.Context) (synced bool, err error) {
+    var dialer net.Dialer
+    conn, err := dialer.DialContext(ctx, "tcp", r.primaryAddr)
+    if err != nil {
+        return false, err
+    }
+    defer conn.Close()
+    
+    stop := context.AfterFunc(ctx, func() { conn.Close() })
+    defer stop()
+    
+    r.mu.Lock()
+    hello := replHello{Epoch: r.epoch, LastSeq: r.status.AppliedSeq}
+    r.status.Connected = true
+    r.mu.Unlock()
+    
+    defer func() {
+        r.mu.Lock()
+        r.status.Connected = false
+        r.mu.Unlock()
+    }()
+    
+    if err := gob.NewEncoder(conn).Encode(hello); err != nil {
+        return false, err
+    }
+    
+    dec := gob.NewDecoder(conn)
+    for {
+        var msg replMessage
+        if err := dec.Decode(&msg); err != nil {
+            return synced, err
+        }
+        
+        var applied uint64
+        switch {
+        case msg.Snapshot != nil:
+            resp, err := r.cs.do(ctx, CacheRequest{Op: OpRestore, Value: *msg.Snapshot})
+            if err != nil {
+                return synced, err
+            }
+            applied = resp.Value.(uint64)
+            synced = true
+        case msg.Mutation != nil:
+            resp, err := r.cs.do(ctx, CacheRequest{Op: OpReplicate, Value: *msg.Mutation})
+            if err != nil {
+                return synced, err
+            }
+            applied = resp.Value.(uint64)
+            synced = true
+        }
+        
+        r.mu.Lock()
+        r.epoch = msg.Epoch
+        r.status.LastContact = time.Now()
+        if applied > 0 {
+            r.status.AppliedSeq = applied
+        }
+        if msg.Heartbeat != nil {
+            r.status.PrimarySeq = msg.Heartbeat.Seq
+            r.status.HeartbeatDelay = time.Since(msg.Heartbeat.SentAt)
+        }
+        if r.status.AppliedSeq > r.status.PrimarySeq {
+            r.status.PrimarySeq = r.status.AppliedSeq
+        }
+        r.mu.Unlock()
+    }
+}
+
+func (r *ReplicationReplica) Status() ReplicaStatus {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    
+    status := r.status
+    status.LagOps = status.PrimarySeq - status.AppliedSeq
+    return status
+}
+
+// Stop disconnects from the primary. The cache stays read-only.
+func (r *ReplicationReplica) Stop() {
+    r.cancel()
+    <-r.done
+}
+
+// Promote stops following the primary, makes the cache writable and starts
+// serving replicas on listenAddr. Other replicas must be pointed at it. It
+// listens first; if promotion fails, the node goes back to being a
+// read-only replica of its primary.
+func (r *ReplicationReplica) Promote(ctx context.Context, listenAddr string) (*ReplicationPrimary, error) {
+    listener, err := net.Listen("tcp", listenAddr)
+    if err != nil {
+        return nil, err
+    }
+    
+    r.Stop()
+    
+    if _, err := r.cs.do(ctx, CacheRequest{Op: OpSetReadOnly, Value: false}); err != nil {
+        listener.Close()
+        r.start()
+        return nil, err
+    }
+    primary, err := startPrimaryOn(ctx, r.cs, listener, 0)
+    if err != nil {
+        r.cs.do(context.WithoutCancel(ctx), CacheRequest{Op: OpSetReadOnly, Value: true})
+        r.start()
+        return nil, err
+    }
+    return primary, nil
+}
+
+// ReplicationAdmin serves replication status and the promotion command:
+//
+//    GET  /replication/status
+//    POST /replication/promote?listen=:7001    Authorization: Bearer <token>
+//
+// Promotion is refused unless the admin was given a token.
+type ReplicationAdmin struct {
+    mu      sync.Mutex
+    token   string
+    primary *ReplicationPrimary
+    replica *ReplicationReplica
+}
+
+func NewPrimaryAdmin(p *ReplicationPrimary, token string) *ReplicationAdmin {
+    return &ReplicationAdmin{primary: p, token: token}
+}
+
+func NewReplicaAdmin(r *ReplicationReplica, token string) *ReplicationAdmin {
+    return &ReplicationAdmin{replica: r, token: token}
+}
+
+func (a *ReplicationAdmin) authorized(r *http.Request) bool {
+    if a.token == "" {
+        return false
+    }
+    got := []byte(r.Header.Get("Authorization"))
+    return subtle.ConstantTimeCompare(got, []byte("Bearer "+a.token)) == 1
+}
+
+func (a *ReplicationAdmin) Register(mux *http.ServeMux) {
+    mux.HandleFunc("GET /replication/status", a.statusHandler)
+    mux.HandleFunc("POST /replication/promote", a.promoteHandler)
+}
+
+func (a *ReplicationAdmin) statusHandler(w http.ResponseWriter, r *http.Request) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    
+    var body interface{}
+    if a.primary != nil {
+        body = map[string]interface{}{"role": "primary", "status": a.primary.Status()}
+    } else {
+        body = map[string]interface{}{"role": "replica", "status": a.replica.Status()}
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(body)
+}
+
+func (a *ReplicationAdmin) promoteHandler(w http.ResponseWriter, r *http.Request) {
+    if !a.authorized(r) {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    
+    if a.primary != nil {
+        http.Error(w, "already primary", http.StatusConflict)
+        return
+    }
+    
+    listen := r.URL.Query().Get("listen")
+    if listen == "" {
+        http.Error(w, "listen address required", http.StatusBadRequest)
+        return
+    }
+    
+    primary, err := a.replica.Promote(r.Context(), listen)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    a.primary, a.replica = primary, nil
+    log.Printf("Promoted to primary, serving replicas on %s", primary.Addr())
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"role": "primary", "status": primary.Status()})
+}
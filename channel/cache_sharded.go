@@ -0,0 +1,224 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "hash/fnv"
+    "sort"
+    "sync"
+    "time"
+)
+
+// ShardedCacheServer spreads keys over several CacheServer actors so that
+// operations on different shards run in parallel. Each shard still owns its
+// map exclusively through its own run goroutine.
+type ShardedCacheServer struct {
+    shards []*CacheServer
+}
+
+func NewShardedCacheServer(shardCount int) *ShardedCacheServer {
+    if shardCount <= 0 {
+        shardCount = 1
+    }
+    
+    scs := &ShardedCacheServer{
+        shards: make([]*CacheServer, shardCount),
+    }
+    for i := range scs.shards {
+        scs.shards[i] = NewCacheServer()
+    }
+    
+    return scs
+}
+
+func (scs *ShardedCacheServer) shardIndex(key string) int {
+    h := fnv.New32a()
+    h.Write([]byte(key))
+    return int(h.Sum32() % uint32(len(scs.shards)))
+}
+
+func (scs *ShardedCacheServer) shard(key string) *CacheServer {
+    return scs.shards[scs.shardIndex(key)]
+}
+
+func (scs *ShardedCacheServer) Get(ctx context.Context, key string) (interface{}, bool, error) {
+    return scs.shard(key).Get(ctx, key)
+}
+
+func (scs *ShardedCacheServer) Set(ctx context.Context, key string, value interface{}) error {
+    return scs.shard(key).Set(ctx, key, value)
+}
+
+func (scs *ShardedCacheServer) SetWithTTL(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+    return scs.shard(key).SetWithTTL(ctx, key, value, ttl)
+}
+
+func (scs *ShardedCacheServer) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func() (interface{}, error)) (interface{}, error) {
+    return scs.shard(key).GetOrLoad(ctx, key, ttl, load)
+}
+
+func (scs *ShardedCacheServer) Delete(ctx context.Context, key string) (bool, error) {
+    return scs.shard(key).Delete(ctx, key)
+}
+
+func (scs *ShardedCacheServer) Exists(ctx context.Context, key string) (bool, error) {
+    return scs.shard(key).Exists(ctx, key)
+}
+
+func (scs *ShardedCacheServer) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+    return scs.shard(key).Incr(ctx, key, delta)
+}
+
+func (scs *ShardedCacheServer) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+    return scs.shard(key).Decr(ctx, key, delta)
+}
+
+func (scs *ShardedCacheServer) CompareAndSwap(ctx context.Context, key string, old, new interface{}) (bool, error) {
+    return scs.shard(key).CompareAndSwap(ctx, key, old, new)
+}
+
+// Keys merges the sorted keys of every shard
+func (scs *ShardedCacheServer) Keys(ctx context.Context, prefix string) ([]string, error) {
+    perShard := make([][]string, len(scs.shards))
+    err := scs.eachShard(func(i int, cs *CacheServer) error {
+        var err error
+        perShard[i], err = cs.Keys(ctx, prefix)
+        return err
+    })
+    if err != nil {
+        return nil, err
+    }
+    
+    var keys []string
+    for _, shardKeys := range perShard {
+        keys = append(keys, shardKeys...)
+    }
+    sort.Strings(keys)
+    return keys, nil
+}
+
+// Close shuts every shard down
+func (scs *ShardedCacheServer) Close(ctx context.Context) error {
+    return scs.eachShard(func(i int, cs *CacheServer) error {
+        return cs.Close(ctx)
+    })
+}
+
+// eachShard calls fn for every shard concurrently, waits for all of them and
+// returns their errors joined
+func (scs *ShardedCacheServer) eachShard(fn func(i int, cs *CacheServer) error) error {
+    var wg sync.WaitGroup
+    errs := make([]error, len(scs.shards))
+    for i, cs := range scs.shards {
+        wg.Add(1)
+        go func(i int, cs *CacheServer) {
+            defer wg.Done()
+            errs[i] = fn(i, cs)
+        }(i, cs)
+    }
+    wg.Wait()
+    
+    return errors.Join(errs...)
+}
+
+// firstErr returns the first per-op error in responses
+func firstErr(responses []CacheResponse) error {
+    for _, resp := range responses {
+        if resp.Err != nil {
+            return resp.Err
+        }
+    }
+    return nil
+}
+
+// MGet looks up keys with one Batch per shard. Results are in key order.
+// There is no snapshot across shards: a concurrent MSet may be seen partly.
+func (scs *ShardedCacheServer) MGet(ctx context.Context, keys []string) ([]interface{}, []bool, error) {
+    ops := make([]CacheRequest, len(keys))
+    for i, key := range keys {
+        ops[i] = CacheRequest{Op: OpGet, Key: key}
+    }
+    
+    responses, err := scs.Batch(ctx, ops)
+    if err != nil {
+        return nil, nil, err
+    }
+    
+    values := make([]interface{}, len(keys))
+    found := make([]bool, len(keys))
+    for i, resp := range responses {
+        values[i], found[i] = resp.Value, resp.Exists
+    }
+    return values, found, firstErr(responses)
+}
+
+// MSet stores every entry with one Batch per shard, the shards in parallel
+func (scs *ShardedCacheServer) MSet(ctx context.Context, entries map[string]interface{}) error {
+    ops := make([]CacheRequest, 0, len(entries))
+    for key, value := range entries {
+        ops = append(ops, CacheRequest{Op: OpSet, Key: key, Value: value})
+    }
+    
+    responses, err := scs.Batch(ctx, ops)
+    if err != nil {
+        return err
+    }
+    return firstErr(responses)
+}
+
+// Batch splits ops by shard and runs the per-shard batches in parallel.
+// Order is kept within a shard; Keys is rejected since it spans shards.
+func (scs *ShardedCacheServer) Batch(ctx context.Context, ops []CacheRequest) ([]CacheResponse, error) {
+    results := make([]CacheResponse, len(ops))
+    groups := make([][]int, len(scs.shards))
+    for i, op := range ops {
+        if op.Op == OpKeys {
+            results[i] = CacheResponse{Err: ErrNotBatchable}
+            continue
+        }
+        idx := scs.shardIndex(op.Key)
+        groups[idx] = append(groups[idx], i)
+    }
+    
+    err := scs.eachShard(func(i int, cs *CacheServer) error {
+        if len(groups[i]) == 0 {
+            return nil
+        }
+        batch := make([]CacheRequest, len(groups[i]))
+        for j, pos := range groups[i] {
+            batch[j] = ops[pos]
+        }
+        
+        responses, err := cs.Batch(ctx, batch)
+        if err != nil {
+            return err
+        }
+        for j, resp := range responses {
+            results[groups[i][j]] = resp
+        }
+        return nil
+    })
+    
+    return results, err
+}
+
+// MDelete removes keys with one Batch per shard and returns how many were present
+func (scs *ShardedCacheServer) MDelete(ctx context.Context, keys []string) (int, error) {
+    ops := make([]CacheRequest, len(keys))
+    for i, key := range keys {
+        ops[i] = CacheRequest{Op: OpDelete, Key: key}
+    }
+    
+    responses, err := scs.Batch(ctx, ops)
+    if err != nil {
+        return 0, err
+    }
+    
+    deleted := 0
+    for _, resp := range responses {
+        if resp.Err == nil && resp.Exists {
+            deleted++
+        }
+    }
+    return deleted, firstErr(responses)
+}
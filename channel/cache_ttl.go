@@ -0,0 +1,49 @@
+package main
+
+import (
+    "container/heap"
+    "time"
+)
+
+type expiryEntry struct {
+    key string
+    at  time.Time
+}
+
+// expiryHeap orders key deadlines, earliest first. It is owned by the
+// CacheServer run goroutine like the rest of the cache state.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+    *h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+    old := *h
+    entry := old[len(old)-1]
+    *h = old[:len(old)-1]
+    return entry
+}
+
+func (h *expiryHeap) add(key string, at time.Time) {
+    heap.Push(h, expiryEntry{key: key, at: at})
+}
+
+func (h expiryHeap) next() (time.Time, bool) {
+    if len(h) == 0 {
+        return time.Time{}, false
+    }
+    return h[0].at, true
+}
+
+// popDue removes and returns the earliest entry if it is due at now
+func (h *expiryHeap) popDue(now time.Time) (expiryEntry, bool) {
+    if len(*h) == 0 || now.Before((*h)[0].at) {
+        return expiryEntry{}, false
+    }
+    return heap.Pop(h).(expiryEntry), true
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "errors"
+    "math"
+    "net/http"
+    "sync"
+    "time"
+)
+
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// LimitAlgorithm computes a new in-flight limit from one finished request
+type LimitAlgorithm interface {
+    Name() string
+    Update(limit float64, sample LimitSample) float64
+}
+
+type LimitSample struct {
+    RTT      time.Duration
+    InFlight int
+    Dropped  bool // request failed or timed out, a sign of overload
+}
+
+// AIMD grows the limit by one while requests succeed under the latency
+// threshold and multiplies it by Backoff on errors or slow responses.
+type AIMD struct {
+    Backoff float64       // 0.9 if unset
+    Timeout time.Duration // RTT above this counts as a drop
+}
+
+func (a *AIMD) Name() string { return "aimd" }
+
+func (a *AIMD) Update(limit float64, s LimitSample) float64 {
+    backoff := a.Backoff
+    if backoff == 0 {
+        backoff = 0.9
+    }
+    
+    if s.Dropped || (a.Timeout > 0 && s.RTT > a.Timeout) {
+        return limit * backoff
+    }
+    // Only grow when the limit is actually being used
+    if float64(s.InFlight)*2 >= limit {
+        return limit + 1
+    }
+    return limit
+}
+
+// Vegas estimates queueing from how far RTT is above the best RTT seen and
+// keeps the estimated queue between alpha and beta requests.
+type Vegas struct {
+    minRTT time.Duration
+}
+
+func (v *Vegas) Name() string { return "vegas" }
+
+func (v *Vegas) Update(limit float64, s LimitSample) float64 {
+    if s.RTT <= 0 {
+        return limit
+    }
+    if v.minRTT == 0 || s.RTT < v.minRTT {
+        v.minRTT = s.RTT
+    }
+    
+    step := math.Max(1, math.Log10(limit))
+    if s.Dropped {
+        return limit - step
+    }
+    
+    queue := limit * (1 - float64(v.minRTT)/float64(s.RTT))
+    alpha, beta := 3*step, 6*step
+    
+    switch {
+    case queue < alpha:
+        return limit + step
+    case queue > beta:
+        return limit - step
+    default:
+        return limit
+    }
+}
+
+// Gradient compares a short term RTT to a long term average and scales the
+// limit by their ratio, plus a queue allowance of sqrt(limit).
+type Gradient struct {
+    Tolerance float64 // how much RTT inflation is acceptable, 1.5 if unset
+    Smoothing float64 // weight of the new estimate, 0.2 if unset
+    
+    longRTT float64
+}
+
+func (g *Gradient) Name() string { return "gradient" }
+
+func (g *Gradient) Update(limit float64, s LimitSample) float64 {
+    tolerance, smoothing := g.Tolerance, g.Smoothing
+    if tolerance == 0 {
+        tolerance = 1.5
+    }
+    if smoothing == 0 {
+        smoothing = 0.2
+    }
+    
+    rtt := float64(s.RTT)
+    if rtt <= 0 {
+        return limit
+    }
+    if g.longRTT == 0 {
+        g.longRTT = rtt
+    }
+    g.longRTT = g.longRTT*0.95 + rtt*0.05
+    
+    // Don't grow a limit that isn't being used
+    if !s.Dropped && float64(s.InFlight) < limit/2 {
+        return limit
+    }
+    
+    gradient := math.Max(0.5, math.Min(1, tolerance*g.longRTT/rtt))
+    if s.Dropped {
+        gradient = 0.5
+    }
+    newLimit := limit*gradient + math.Sqrt(limit)
+    
+    return limit*(1-smoothing) + newLimit*smoothing
+}
+
+type ConcurrencyLimiterConfig struct {
+    Algorithm    LimitAlgorithm
+    InitialLimit int
+    MinLimit     int
+    MaxLimit     int
+    MaxWait      time.Duration // how long an over-limit request may queue, 0 rejects at once
+    MaxQueue     int           // waiting requests beyond this are rejected
+}
+
+type ConcurrencyStats struct {
+    Algorithm string `json:"algorithm"`
+    Limit     int    `json:"limit"`
+    InFlight  int    `json:"in_flight"`
+    Queued    int    `json:"queued"`
+    Admitted  int64  `json:"admitted"`
+    Rejected  int64  `json:"rejected"`
+}
+
+// ConcurrencyLimiter caps in-flight requests and adapts the cap to the
+// latency and error rate it observes.
+type ConcurrencyLimiter struct {
+    mu       sync.Mutex
+    cfg      ConcurrencyLimiterConfig
+    limit    float64
+    inFlight int
+    waiters  *list.List // of chan struct{}
+    admitted int64
+    rejected int64
+    
+    Rejection RejectionConfig
+}
+
+func NewConcurrencyLimiter(cfg ConcurrencyLimiterConfig) *ConcurrencyLimiter {
+    if cfg.Algorithm == nil {
+        cfg.Algorithm = &Gradient{}
+    }
+    if cfg.MinLimit <= 0 {
+        cfg.MinLimit = 1
+    }
+    if cfg.MaxLimit <= 0 {
+        cfg.MaxLimit = 1000
+    }
+    if cfg.InitialLimit <= 0 {
+        cfg.InitialLimit = 20
+    }
+    
+    return &ConcurrencyLimiter{
+        cfg:     cfg,
+        limit:   float64(cfg.InitialLimit),
+        waiters: list.New(),
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusServiceUnavailable,
+            Body:       "Server overloaded",
+        },
+    }
+}
+
+// Acquire takes an in-flight slot, queueing up to MaxWait for one.
+// The returned func must be called with the outcome of the request.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) (func(dropped bool), error) {
+    cl.mu.Lock()
+    
+    if cl.inFlight < int(cl.limit) {
+        cl.inFlight++
+        cl.admitted++
+        cl.mu.Unlock()
+        return cl.releaser(), nil
+    }
+    
+    if cl.cfg.MaxWait <= 0 || (cl.cfg.MaxQueue > 0 && cl.waiters.Len() >= cl.cfg.MaxQueue) {
+        cl.rejected++
+        cl.mu.Unlock()
+        return nil, ErrLimitExceeded
+    }
+    
+    ready := make(chan struct{})
+    elem := cl.waiters.PushBack(ready)
+    cl.mu.Unlock()
+    
+    timer := time.NewTimer(cl.cfg.MaxWait)
+    defer timer.Stop()
+    
+    select {
+    case <-ready:
+        return cl.releaser(), nil
+    case <-timer.C:
+    case <-ctx.Done():
+    }
+    
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    
+    select {
+    case <-ready:
+        // Handed a slot while giving up, keep it
+        return cl.releaser(), nil
+    default:
+    }
+    cl.waiters.Remove(elem)
+    cl.rejected++
+    return nil, ErrLimitExceeded
+}
+
+func (cl *ConcurrencyLimiter) releaser() func(dropped bool) {
+    start := time.Now()
+    var once sync.Once
+    
+    return func(dropped bool) {
+        once.Do(func() {
+            cl.release(LimitSample{RTT: time.Since(start), Dropped: dropped})
+        })
+    }
+}
+
+func (cl *ConcurrencyLimiter) release(sample LimitSample) {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    
+    sample.InFlight = cl.inFlight
+    cl.inFlight--
+    
+    newLimit := cl.cfg.Algorithm.Update(cl.limit, sample)
+    cl.limit = math.Max(float64(cl.cfg.MinLimit), math.Min(float64(cl.cfg.MaxLimit), newLimit))
+    
+    // Hand freed slots straight to queued requests
+    for cl.waiters.Len() > 0 && cl.inFlight < int(cl.limit) {
+        ready := cl.waiters.Remove(cl.waiters.Front()).(chan struct{})
+        cl.inFlight++
+        cl.admitted++
+        close(ready)
+    }
+}
+
+// Limit returns the current adaptive limit
+func (cl *ConcurrencyLimiter) Limit() int {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    
+    return int(cl.limit)
+}
+
+func (cl *ConcurrencyLimiter) Stats() ConcurrencyStats {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
+    
+    return ConcurrencyStats{
+        Algorithm: cl.cfg.Algorithm.Name(),
+        Limit:     int(cl.limit),
+        InFlight:  cl.inFlight,
+        Queued:    cl.waiters.Len(),
+        Admitted:  cl.admitted,
+        Rejected:  cl.rejected,
+    }
+}
+
+// StatsHandler serves the live limit as JSON for dashboards
+func (cl *ConcurrencyLimiter) StatsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(cl.Stats())
+}
+
+func (cl *ConcurrencyLimiter) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        release, err := cl.Acquire(r.Context())
+        if err != nil {
+            writeRejection(w, cl.Rejection, time.Second)
+            return
+        }
+        
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        defer func() {
+            release(rec.status >= http.StatusInternalServerError)
+        }()
+        
+        next.ServeHTTP(rec, r)
+    })
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+    r.status = status
+    r.ResponseWriter.WriteHeader(status)
+}
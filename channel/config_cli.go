@@ -0,0 +1,85 @@
+package main
+
+import (
+    "bufio"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+)
+
+// Usage:
+//
+//    config keygen                  print a new key for CONFIG_KEY
+//    config encrypt [value]         print ${enc:...} for value, or for stdin
+//    config [-config path] [-database.port=N ...]
+//                                   load and print the config, redacted, with
+//                                   the source of every value
+func main() {
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "keygen":
+            key, err := NewConfigKey()
+            if err != nil {
+                fmt.Fprintf(os.Stderr, "Error generating key: %v\n", err)
+                os.Exit(1)
+            }
+            fmt.Println(key)
+            return
+        case "encrypt":
+            if err := encryptCommand(os.Args[2:]); err != nil {
+                fmt.Fprintf(os.Stderr, "Error encrypting: %v\n", err)
+                os.Exit(1)
+            }
+            return
+        }
+    }
+    
+    fs := flag.NewFlagSet("config", flag.ExitOnError)
+    configPath := fs.String("config", "config.json", "config file (.json, .yaml, .toml or .ini)")
+    flags := NewFlagSource(fs)
+    fs.Parse(os.Args[1:])
+    
+    cm, err := NewConfigManagerWithLoader(NewConfigLoader(
+        NewDefaultsSource(DefaultConfig),
+        NewOptionalFileSource(*configPath),
+        NewEnvSource("APP"),
+        flags,
+    ))
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+        os.Exit(1)
+    }
+    
+    data, _ := json.MarshalIndent(Redacted(cm.GetCurrent()), "", "  ")
+    fmt.Println(string(data))
+    for _, origin := range cm.Explain("") {
+        fmt.Println(origin)
+    }
+}
+
+// encryptCommand reads the plaintext from args or one line of stdin, so
+// it does not have to appear in shell history
+func encryptCommand(args []string) error {
+    key, err := configKey()
+    if err != nil {
+        return err
+    }
+    
+    plaintext := strings.Join(args, " ")
+    if len(args) == 0 {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && line == "" {
+            return fmt.Errorf("reading value from stdin: %w", err)
+        }
+        plaintext = strings.TrimRight(line, "\r\n")
+    }
+    
+    value, err := EncryptValue(key, plaintext)
+    if err != nil {
+        return err
+    }
+    fmt.Println(value)
+    return nil
+}
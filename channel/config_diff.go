@@ -0,0 +1,118 @@
+package main
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+)
+
+// ConfigChange is one value that differs between two configs. Old and New
+// of secret fields are redacted.
+type ConfigChange struct {
+    Path   string      `json:"path"`
+    Old    interface{} `json:"old"`
+    New    interface{} `json:"new"`
+    Secret bool        `json:"secret,omitempty"`
+}
+
+func (c ConfigChange) String() string {
+    return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+}
+
+// ConfigUpdate is what path subscribers receive: the new config and the
+// changes they asked for
+type ConfigUpdate struct {
+    Config  Config
+    Changes []ConfigChange
+}
+
+// DiffConfig lists changed leaf paths in field order, map entries by key
+func DiffConfig(old, new Config) []ConfigChange {
+    var changes []ConfigChange
+    diffValues(reflect.ValueOf(old), reflect.ValueOf(new), "", &changes)
+    return changes
+}
+
+func diffValues(old, new reflect.Value, prefix string, changes *[]ConfigChange) {
+    for i := 0; i < old.NumField(); i++ {
+        name := jsonName(old.Type().Field(i))
+        if name == "" {
+            continue
+        }
+        path := joinPath(prefix, name)
+        
+        if old.Field(i).Kind() == reflect.Struct {
+            diffValues(old.Field(i), new.Field(i), path, changes)
+            continue
+        }
+        if old.Field(i).Kind() == reflect.Map {
+            diffMaps(old.Field(i), new.Field(i), path, changes)
+            continue
+        }
+        addChange(old.Field(i).Interface(), new.Field(i).Interface(), path, changes)
+    }
+}
+
+// diffMaps compares entries by key, e.g. "flags.new_checkout.percentage";
+// an added or removed entry is one change with a nil side
+func diffMaps(old, new reflect.Value, prefix string, changes *[]ConfigChange) {
+    keys := mapKeys(old)
+    for _, key := range mapKeys(new) {
+        if !old.MapIndex(reflect.ValueOf(key)).IsValid() {
+            keys = append(keys, key)
+        }
+    }
+    
+    for _, key := range keys {
+        path := joinPath(prefix, key)
+        o := old.MapIndex(reflect.ValueOf(key))
+        n := new.MapIndex(reflect.ValueOf(key))
+        switch {
+        case o.IsValid() && n.IsValid() && o.Kind() == reflect.Struct:
+            diffValues(o, n, path, changes)
+        case o.IsValid() && n.IsValid():
+            addChange(o.Interface(), n.Interface(), path, changes)
+        case o.IsValid():
+            addChange(o.Interface(), nil, path, changes)
+        default:
+            addChange(nil, n.Interface(), path, changes)
+        }
+    }
+}
+
+func addChange(old, new interface{}, path string, changes *[]ConfigChange) {
+    if reflect.DeepEqual(old, new) {
+        return
+    }
+    *changes = append(*changes, ConfigChange{
+        Path:   path,
+        Old:    RedactValue(path, old),
+        New:    RedactValue(path, new),
+        Secret: isSecret(path),
+    })
+}
+
+// matchesPath reports whether path is one of paths or inside one of them;
+// no paths matches everything
+func matchesPath(path string, paths []string) bool {
+    if len(paths) == 0 {
+        return true
+    }
+    for _, p := range paths {
+        if path == p || strings.HasPrefix(path, p+".") {
+            return true
+        }
+    }
+    return false
+}
+
+// filterChanges keeps the changes under paths
+func filterChanges(changes []ConfigChange, paths []string) []ConfigChange {
+    var matched []ConfigChange
+    for _, change := range changes {
+        if matchesPath(change.Path, paths) {
+            matched = append(matched, change)
+        }
+    }
+    return matched
+}
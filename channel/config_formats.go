@@ -0,0 +1,355 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+// The parsers below cover the subset of YAML, TOML and INI that config
+// files use: nested sections, scalar values, comments and scalar lists.
+// Anything outside that subset is an error with its line number rather
+// than a silently different config.
+
+// parseScalar types an unquoted value and unquotes a quoted one
+func parseScalar(s string) (interface{}, error) {
+    s = strings.TrimSpace(s)
+    if s != "" && s[0] == '"' {
+        unquoted, err := strconv.Unquote(s)
+        if err != nil {
+            return nil, fmt.Errorf("invalid double-quoted string %s", s)
+        }
+        return unquoted, nil
+    }
+    if s != "" && s[0] == '\'' {
+        // '' is an escaped quote inside a single-quoted string
+        if len(s) < 2 || s[len(s)-1] != '\'' || strings.Contains(strings.ReplaceAll(s[1:len(s)-1], "''", ""), "'") {
+            return nil, fmt.Errorf("invalid single-quoted string %s", s)
+        }
+        return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+    }
+    if s != "" && strings.ContainsRune("{&*!|>%@`", rune(s[0])) {
+        return nil, fmt.Errorf("unsupported value %s", s)
+    }
+    
+    switch s {
+    case "true", "True", "TRUE":
+        return true, nil
+    case "false", "False", "FALSE":
+        return false, nil
+    case "", "~", "null":
+        return nil, nil
+    }
+    if n, err := strconv.ParseInt(strings.ReplaceAll(s, "_", ""), 10, 64); err == nil {
+        return n, nil
+    }
+    if f, err := strconv.ParseFloat(s, 64); err == nil {
+        return f, nil
+    }
+    return s, nil
+}
+
+// stripComment drops a trailing comment that is not inside quotes
+func stripComment(line string, markers string) string {
+    var quote rune
+    for i, c := range line {
+        switch {
+        case quote != 0:
+            if c == quote {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case strings.ContainsRune(markers, c) && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+            return line[:i]
+        }
+    }
+    return line
+}
+
+// splitList splits on commas outside quotes
+func splitList(s string) ([]string, error) {
+    var items []string
+    var quote rune
+    start := 0
+    for i, c := range s {
+        switch {
+        case quote != 0:
+            if c == quote && (quote != '"' || !escaped(s, i)) {
+                quote = 0
+            }
+        case c == '"' || c == '\'':
+            quote = c
+        case c == '[' || c == ']' || c == '{' || c == '}':
+            return nil, fmt.Errorf("nested lists and tables are not supported")
+        case c == ',':
+            items = append(items, s[start:i])
+            start = i + 1
+        }
+    }
+    if quote != 0 {
+        return nil, fmt.Errorf("unterminated string in list")
+    }
+    return append(items, s[start:]), nil
+}
+
+// escaped reports whether s[i] follows an odd number of backslashes
+func escaped(s string, i int) bool {
+    n := 0
+    for i--; i >= 0 && s[i] == '\\'; i-- {
+        n++
+    }
+    return n%2 == 1
+}
+
+// parseInlineList parses [a, b, "c"]; a trailing comma is allowed
+func parseInlineList(s string) ([]interface{}, error) {
+    parts, err := splitList(s[1 : len(s)-1])
+    if err != nil {
+        return nil, err
+    }
+    if n := len(parts); strings.TrimSpace(parts[n-1]) == "" {
+        parts = parts[:n-1]
+    }
+    
+    items := []interface{}{}
+    for _, part := range parts {
+        if strings.TrimSpace(part) == "" {
+            return nil, fmt.Errorf("empty item in list %s", s)
+        }
+        item, err := parseScalar(part)
+        if err != nil {
+            return nil, err
+        }
+        items = append(items, item)
+    }
+    return items, nil
+}
+
+func parseValue(s string) (interface{}, error) {
+    s = strings.TrimSpace(s)
+    if strings.HasPrefix(s, "[") {
+        if !strings.HasSuffix(s, "]") {
+            return nil, fmt.Errorf("lists must open and close on one line")
+        }
+        return parseInlineList(s)
+    }
+    return parseScalar(s)
+}
+
+type yamlFrame struct {
+    indent      int
+    childIndent int // indent of the keys in tree, -1 until the first one
+    tree        map[string]interface{}
+    list        bool // the key turned out to hold a list, not a section
+}
+
+func parseYAML(data []byte) (map[string]interface{}, error) {
+    root := make(map[string]interface{})
+    stack := []*yamlFrame{{indent: -1, childIndent: -1, tree: root}}
+    var listKey string
+    var listOwner map[string]interface{}
+    var listIndent int
+    
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        fail := func(format string, args ...interface{}) (map[string]interface{}, error) {
+            return nil, fmt.Errorf("yaml line %d: %s", lineNo, fmt.Sprintf(format, args...))
+        }
+        
+        raw := strings.TrimRight(stripComment(scanner.Text(), "#"), " \t")
+        trimmed := strings.TrimSpace(raw)
+        if trimmed == "" {
+            continue
+        }
+        if trimmed == "---" {
+            if lineNo > 1 {
+                return fail("multiple documents are not supported")
+            }
+            continue
+        }
+        indent := len(raw) - len(strings.TrimLeft(raw, " "))
+        if raw[indent] == '\t' {
+            return fail("tabs are not allowed in indentation")
+        }
+        
+        if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+            if listOwner == nil || indent < listIndent {
+                return fail("list item without a key")
+            }
+            text := strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+            if isYAMLMapping(text) {
+                return fail("list items must be scalars, got %q", text)
+            }
+            if strings.HasPrefix(text, "[") || strings.HasPrefix(text, "-") {
+                return fail("nested lists are not supported")
+            }
+            item, err := parseScalar(text)
+            if err != nil {
+                return fail("%v", err)
+            }
+            // The key was opened as a section, the first item turns it into a list
+            stack[len(stack)-1].list = true
+            items, _ := listOwner[listKey].([]interface{})
+            listOwner[listKey] = append(items, item)
+            continue
+        }
+        
+        for len(stack) > 1 && indent <= stack[len(stack)-1].indent {
+            stack = stack[:len(stack)-1]
+        }
+        frame := stack[len(stack)-1]
+        if frame.list {
+            return fail("key after the list items of %q", listKey)
+        }
+        if frame.childIndent == -1 {
+            frame.childIndent = indent
+        } else if indent != frame.childIndent {
+            return fail("unexpected indentation")
+        }
+        
+        key, value, ok := strings.Cut(trimmed, ":")
+        if !ok {
+            return fail("expected key: value")
+        }
+        key, err := parseYAMLKey(key)
+        if err != nil {
+            return fail("%v", err)
+        }
+        value = strings.TrimSpace(value)
+        
+        if value == "" {
+            // Either a nested section or a block list follows
+            child := make(map[string]interface{})
+            frame.tree[key] = child
+            stack = append(stack, &yamlFrame{indent: indent, childIndent: -1, tree: child})
+            listKey, listOwner, listIndent = key, frame.tree, indent
+            continue
+        }
+        parsed, err := parseValue(value)
+        if err != nil {
+            return fail("%v", err)
+        }
+        frame.tree[key] = parsed
+        listOwner = nil
+    }
+    return root, scanner.Err()
+}
+
+// isYAMLMapping reports whether an unquoted list item is really key: value
+func isYAMLMapping(text string) bool {
+    if text == "" || text[0] == '"' || text[0] == '\'' {
+        return false
+    }
+    return strings.Contains(text, ": ") || strings.HasSuffix(text, ":")
+}
+
+func parseYAMLKey(key string) (string, error) {
+    key = strings.TrimSpace(key)
+    if key == "" {
+        return "", fmt.Errorf("empty key")
+    }
+    if key[0] == '"' || key[0] == '\'' {
+        unquoted, err := parseScalar(key)
+        if err != nil {
+            return "", err
+        }
+        return unquoted.(string), nil
+    }
+    if strings.ContainsRune("?&*!|>{[", rune(key[0])) {
+        return "", fmt.Errorf("unsupported key %s", key)
+    }
+    return key, nil
+}
+
+func parseTOML(data []byte) (map[string]interface{}, error) {
+    root := make(map[string]interface{})
+    section := root
+    
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        fail := func(format string, args ...interface{}) (map[string]interface{}, error) {
+            return nil, fmt.Errorf("toml line %d: %s", lineNo, fmt.Sprintf(format, args...))
+        }
+        
+        line := strings.TrimSpace(stripComment(scanner.Text(), "#"))
+        if line == "" {
+            continue
+        }
+        
+        if strings.HasPrefix(line, "[[") {
+            return fail("arrays of tables are not supported")
+        }
+        if strings.HasPrefix(line, "[") {
+            if !strings.HasSuffix(line, "]") {
+                return fail("unterminated table header")
+            }
+            section = root
+            for _, part := range strings.Split(line[1:len(line)-1], ".") {
+                part = strings.Trim(strings.TrimSpace(part), `"`)
+                if part == "" || strings.ContainsAny(part, "[]") {
+                    return fail("invalid table name %s", line)
+                }
+                child, ok := section[part].(map[string]interface{})
+                if !ok {
+                    if _, exists := section[part]; exists {
+                        return fail("%s is not a table", part)
+                    }
+                    child = make(map[string]interface{})
+                    section[part] = child
+                }
+                section = child
+            }
+            continue
+        }
+        
+        key, value, ok := strings.Cut(line, "=")
+        if !ok {
+            return fail("expected key = value")
+        }
+        value = strings.TrimSpace(value)
+        if strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''") {
+            return fail("multi-line strings are not supported")
+        }
+        parsed, err := parseValue(value)
+        if err != nil {
+            return fail("%v", err)
+        }
+        setPath(section, strings.Trim(strings.TrimSpace(key), `"`), parsed)
+    }
+    return root, scanner.Err()
+}
+
+func parseINI(data []byte) (map[string]interface{}, error) {
+    root := make(map[string]interface{})
+    section := root
+    
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for lineNo := 1; scanner.Scan(); lineNo++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || line[0] == ';' || line[0] == '#' {
+            continue
+        }
+        
+        if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+            name := strings.TrimSpace(line[1 : len(line)-1])
+            section = make(map[string]interface{})
+            setPath(root, name, section)
+            continue
+        }
+        
+        sep := strings.IndexAny(line, "=:")
+        if sep < 0 {
+            return nil, fmt.Errorf("ini line %d: expected key = value", lineNo)
+        }
+        value := strings.TrimSpace(stripComment(line[sep+1:], ";#"))
+        if unquoted, err := strconv.Unquote(value); err == nil {
+            value = unquoted
+        }
+        // INI has no types, decodeTree converts to the field type
+        section[strings.TrimSpace(line[:sep])] = value
+    }
+    return root, scanner.Err()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// configHistorySize is how many versions ConfigManager keeps
+const configHistorySize = 32
+
+var ErrConfigVersionNotFound = errors.New("config version not in history")
+
+// ConfigVersion is one applied config. The config itself is kept for
+// rollback and diffs and is only served redacted.
+type ConfigVersion struct {
+    Version    int            `json:"version"`
+    Time       time.Time      `json:"time"`
+    SourceHash string         `json:"source_hash"`
+    Changes    []ConfigChange `json:"changes"`
+    RollbackOf int            `json:"rollback_of,omitempty"`
+    
+    config  Config
+    origins map[string]ConfigOrigin
+}
+
+// record appends a version to the ring; the caller holds cm.mu
+func (cm *ConfigManager) record(loaded *LoadedConfig, changes []ConfigChange, rollbackOf int) int {
+    version := 1
+    if n := len(cm.history); n > 0 {
+        version = cm.history[n-1].Version + 1
+    }
+    
+    cm.history = append(cm.history, ConfigVersion{
+        Version:    version,
+        Time:       time.Now(),
+        SourceHash: loaded.Hash,
+        Changes:    changes,
+        RollbackOf: rollbackOf,
+        config:     loaded.Config,
+        origins:    loaded.Origins,
+    })
+    if len(cm.history) > configHistorySize {
+        cm.history = cm.history[len(cm.history)-configHistorySize:]
+    }
+    return version
+}
+
+// History lists the kept versions, oldest first
+func (cm *ConfigManager) History() []ConfigVersion {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    history := make([]ConfigVersion, len(cm.history))
+    copy(history, cm.history)
+    return history
+}
+
+func (cm *ConfigManager) version(n int) (ConfigVersion, error) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    for _, v := range cm.history {
+        if v.Version == n {
+            return v, nil
+        }
+    }
+    return ConfigVersion{}, fmt.Errorf("v%d: %w", n, ErrConfigVersionNotFound)
+}
+
+// Rollback makes an earlier version current again. It stays in effect until
+// a watched file or source changes and the sources are reloaded.
+func (cm *ConfigManager) Rollback(n int) error {
+    v, err := cm.version(n)
+    if err != nil {
+        return err
+    }
+    
+    origins := make(map[string]ConfigOrigin, len(v.origins))
+    for path, origin := range v.origins {
+        origin.Source = fmt.Sprintf("rollback to v%d (%s)", n, origin.Source)
+        origins[path] = origin
+    }
+    
+    log.Printf("Rolling config back to v%d", n)
+    return cm.manager.Set(&appliedConfig{
+        LoadedConfig: LoadedConfig{Config: v.config, Origins: origins, Hash: v.SourceHash},
+        rollbackOf:   n,
+    })
+}
+
+// ConfigAdmin serves the config, its history and rollback:
+//
+//    GET  /config                      current config, redacted
+//    GET  /config/history              versions with their diffs
+//    GET  /config/history/{version}    one version's config, redacted
+//    GET  /config/diff?from=3&to=5     diff between two versions, to defaults to current
+//    POST /config/rollback/{version}   Authorization: Bearer <token>
+//
+// Rollback is refused unless the admin was given a token.
+type ConfigAdmin struct {
+    cm    *ConfigManager
+    token string
+}
+
+func NewConfigAdmin(cm *ConfigManager, token string) *ConfigAdmin {
+    return &ConfigAdmin{cm: cm, token: token}
+}
+
+func (a *ConfigAdmin) authorized(r *http.Request) bool {
+    if a.token == "" {
+        return false
+    }
+    got := []byte(r.Header.Get("Authorization"))
+    return subtle.ConstantTimeCompare(got, []byte("Bearer "+a.token)) == 1
+}
+
+func (a *ConfigAdmin) Register(mux *http.ServeMux) {
+    mux.HandleFunc("GET /config", a.currentHandler)
+    mux.HandleFunc("GET /config/history", a.historyHandler)
+    mux.HandleFunc("GET /config/history/{version}", a.versionHandler)
+    mux.HandleFunc("GET /config/diff", a.diffHandler)
+    mux.HandleFunc("POST /config/rollback/{version}", a.rollbackHandler)
+}
+
+func (a *ConfigAdmin) currentHandler(w http.ResponseWriter, r *http.Request) {
+    a.cm.mu.Lock()
+    applied := a.cm.applied.Value
+    body := map[string]interface{}{"config": Redacted(applied.Config)}
+    if n := len(a.cm.history); n > 0 {
+        body["version"] = a.cm.history[n-1].Version
+    }
+    if applied.rollbackOf > 0 {
+        body["rolled_back_to"] = applied.rollbackOf
+    }
+    a.cm.mu.Unlock()
+    
+    writeConfigJSON(w, body)
+}
+
+func (a *ConfigAdmin) historyHandler(w http.ResponseWriter, r *http.Request) {
+    writeConfigJSON(w, a.cm.History())
+}
+
+func (a *ConfigAdmin) versionHandler(w http.ResponseWriter, r *http.Request) {
+    v, ok := a.lookup(w, r.PathValue("version"))
+    if !ok {
+        return
+    }
+    writeConfigJSON(w, map[string]interface{}{
+        "version":     v.Version,
+        "time":        v.Time,
+        "source_hash": v.SourceHash,
+        "config":      Redacted(v.config),
+    })
+}
+
+func (a *ConfigAdmin) diffHandler(w http.ResponseWriter, r *http.Request) {
+    from, ok := a.lookup(w, r.URL.Query().Get("from"))
+    if !ok {
+        return
+    }
+    
+    to := ConfigVersion{config: a.cm.GetCurrent()}
+    if s := r.URL.Query().Get("to"); s != "" {
+        if to, ok = a.lookup(w, s); !ok {
+            return
+        }
+    }
+    writeConfigJSON(w, DiffConfig(from.config, to.config))
+}
+
+func (a *ConfigAdmin) rollbackHandler(w http.ResponseWriter, r *http.Request) {
+    if !a.authorized(r) {
+        w.Header().Set("WWW-Authenticate", "Bearer")
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    
+    n, err := strconv.Atoi(r.PathValue("version"))
+    if err != nil {
+        http.Error(w, "version must be a number", http.StatusBadRequest)
+        return
+    }
+    if err := a.cm.Rollback(n); err != nil {
+        status := http.StatusUnprocessableEntity
+        if errors.Is(err, ErrConfigVersionNotFound) {
+            status = http.StatusNotFound
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+    a.currentHandler(w, r)
+}
+
+func (a *ConfigAdmin) lookup(w http.ResponseWriter, s string) (ConfigVersion, bool) {
+    n, err := strconv.Atoi(s)
+    if err != nil {
+        http.Error(w, "version must be a number", http.StatusBadRequest)
+        return ConfigVersion{}, false
+    }
+    v, err := a.cm.version(n)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return ConfigVersion{}, false
+    }
+    return v, true
+}
+
+func writeConfigJSON(w http.ResponseWriter, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(body)
+}
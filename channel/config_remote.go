@@ -0,0 +1,424 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "mime"
+    "net/http"
+    "net/url"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+)
+
+// RemoteOptions configures a RemoteSource
+type RemoteOptions struct {
+    URL      string
+    Client   *http.Client  // http.DefaultClient by default
+    Interval time.Duration // between polls, 30s by default; ignored when long-polling
+    LongPoll time.Duration // how long the server may hold a request, 0 disables it
+    // CachePath keeps the last fetched config for a cold start without the server
+    CachePath  string
+    MinBackoff time.Duration // 1s by default
+    MaxBackoff time.Duration // 1m by default
+}
+
+// remoteCache is the cache file content
+type remoteCache struct {
+    ETag   string `json:"etag"`
+    Format string `json:"format"`
+    Data   []byte `json:"data"`
+}
+
+// RemoteSource fetches config from an HTTP endpoint. Polls send
+// If-None-Match so unchanged config costs a 304. With LongPoll the server
+// holds the request until the config changes, see ConfigServer.
+type RemoteSource struct {
+    opts    RemoteOptions
+    changes chan struct{}
+    cancel  context.CancelFunc
+    done    chan struct{}
+    
+    mu   sync.Mutex
+    tree map[string]interface{}
+    etag string
+    err  error
+}
+
+// NewRemoteSource fetches once, falling back to the cache file, then keeps
+// polling until Close
+func NewRemoteSource(opts RemoteOptions) *RemoteSource {
+    if opts.Client == nil {
+        opts.Client = http.DefaultClient
+    }
+    if opts.Interval <= 0 {
+        opts.Interval = 30 * time.Second
+    }
+    if opts.MinBackoff <= 0 {
+        opts.MinBackoff = time.Second
+    }
+    if opts.MaxBackoff <= 0 {
+        opts.MaxBackoff = time.Minute
+    }
+    
+    ctx, cancel := context.WithCancel(context.Background())
+    s := &RemoteSource{
+        opts:    opts,
+        changes: make(chan struct{}, 1),
+        cancel:  cancel,
+        done:    make(chan struct{}),
+    }
+    
+    // Don't hold up startup for a long poll
+    if err := s.fetch(ctx, false); err != nil {
+        log.Printf("Error fetching remote config: %v", err)
+        if err := s.loadCache(); err != nil {
+            log.Printf("Error reading remote config cache: %v", err)
+        }
+    }
+    // The first Load reads the initial config, it is no change
+    select {
+    case <-s.changes:
+    default:
+    }
+    
+    go s.poll(ctx)
+    
+    return s
+}
+
+func (s *RemoteSource) Name() string {
+    return "remote " + s.opts.URL
+}
+
+// untrusted keeps ${env:}, ${file:} and ${enc:} references out of remote
+// configs, see untrustedSource
+func (s *RemoteSource) untrusted() {}
+
+// Load returns the last fetched config
+func (s *RemoteSource) Load() (map[string]interface{}, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    if s.tree == nil {
+        if s.err != nil {
+            return nil, s.err
+        }
+        return nil, errors.New("no config fetched yet")
+    }
+    return s.tree, nil
+}
+
+func (s *RemoteSource) Changes() <-chan struct{} {
+    return s.changes
+}
+
+// Close stops polling and closes Changes
+func (s *RemoteSource) Close() {
+    s.cancel()
+    <-s.done
+}
+
+func (s *RemoteSource) poll(ctx context.Context) {
+    defer close(s.done)
+    defer close(s.changes)
+    
+    failures := 0
+    for {
+        var wait time.Duration
+        start := time.Now()
+        if err := s.fetch(ctx, s.opts.LongPoll > 0); err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            failures++
+            wait = s.backoff(failures)
+            log.Printf("Error fetching remote config, retrying in %v: %v", wait.Round(time.Millisecond), err)
+        } else {
+            failures = 0
+            if s.opts.LongPoll <= 0 {
+                wait = s.opts.Interval
+            } else if time.Since(start) < s.opts.MinBackoff {
+                // The server answered at once, it may not hold requests
+                wait = s.opts.MinBackoff
+            }
+        }
+        
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(wait):
+        }
+    }
+}
+
+// backoff doubles from MinBackoff up to MaxBackoff and picks a random
+// point in the upper half, so instances that failed together don't retry
+// in lockstep
+func (s *RemoteSource) backoff(failures int) time.Duration {
+    ceiling := s.opts.MinBackoff
+    for i := 1; i < failures && ceiling < s.opts.MaxBackoff; i++ {
+        ceiling *= 2
+    }
+    if ceiling > s.opts.MaxBackoff {
+        ceiling = s.opts.MaxBackoff
+    }
+    return ceiling/2 + time.Duration(rand.Int63n(int64(ceiling/2)+1))
+}
+
+// fetch gets the config unless it still matches our ETag
+func (s *RemoteSource) fetch(ctx context.Context, longPoll bool) error {
+    u, err := url.Parse(s.opts.URL)
+    if err != nil {
+        return err
+    }
+    timeout := 10 * time.Second
+    if longPoll {
+        q := u.Query()
+        q.Set("wait", s.opts.LongPoll.String())
+        u.RawQuery = q.Encode()
+        timeout += s.opts.LongPoll
+    }
+    
+    ctx, cancel := context.WithTimeout(ctx, timeout)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+    if err != nil {
+        return err
+    }
+    
+    s.mu.Lock()
+    etag := s.etag
+    s.mu.Unlock()
+    if etag != "" {
+        req.Header.Set("If-None-Match", etag)
+    }
+    
+    resp, err := s.opts.Client.Do(req)
+    if err != nil {
+        s.setErr(err)
+        return err
+    }
+    defer resp.Body.Close()
+    
+    switch resp.StatusCode {
+    case http.StatusNotModified:
+        return nil
+    case http.StatusOK:
+    default:
+        err := fmt.Errorf("%s: %s", s.opts.URL, resp.Status)
+        s.setErr(err)
+        return err
+    }
+    
+    data, err := io.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    cache := remoteCache{ETag: resp.Header.Get("ETag"), Format: formatOf(resp.Header.Get("Content-Type")), Data: data}
+    if err := s.update(cache); err != nil {
+        return err
+    }
+    if err := s.saveCache(cache); err != nil {
+        log.Printf("Error writing remote config cache: %v", err)
+    }
+    return nil
+}
+
+// update parses a fetched config and announces it
+func (s *RemoteSource) update(cache remoteCache) error {
+    tree, err := parseConfigData(cache.Format, cache.Data)
+    if err != nil {
+        err = fmt.Errorf("%s: %w", s.opts.URL, err)
+        s.setErr(err)
+        return err
+    }
+    
+    s.mu.Lock()
+    s.tree, s.etag, s.err = tree, cache.ETag, nil
+    s.mu.Unlock()
+    
+    select {
+    case s.changes <- struct{}{}:
+    default:
+        // A change is already pending, Load will see this one too
+    }
+    return nil
+}
+
+func (s *RemoteSource) setErr(err error) {
+    s.mu.Lock()
+    s.err = err
+    s.mu.Unlock()
+}
+
+// formatOf maps a Content-Type such as application/yaml to a format
+func formatOf(contentType string) string {
+    mediaType, _, _ := mime.ParseMediaType(contentType)
+    if i := strings.LastIndexAny(mediaType, "/+"); i >= 0 {
+        return mediaType[i+1:]
+    }
+    return "json"
+}
+
+func (s *RemoteSource) loadCache() error {
+    if s.opts.CachePath == "" {
+        return errors.New("no cache file configured")
+    }
+    data, err := os.ReadFile(s.opts.CachePath)
+    if err != nil {
+        return err
+    }
+    var cache remoteCache
+    if err := json.Unmarshal(data, &cache); err != nil {
+        return err
+    }
+    
+    log.Printf("Using cached remote config from %s", s.opts.CachePath)
+    return s.update(cache)
+}
+
+// saveCache writes through a temp file so a crash never leaves half a cache
+func (s *RemoteSource) saveCache(cache remoteCache) error {
+    if s.opts.CachePath == "" {
+        return nil
+    }
+    data, err := json.Marshal(cache)
+    if err != nil {
+        return err
+    }
+    
+    tmp, err := os.CreateTemp(filepath.Dir(s.opts.CachePath), filepath.Base(s.opts.CachePath)+".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), s.opts.CachePath)
+}
+
+// ConfigServer is a reference endpoint for RemoteSource:
+//
+//    GET /config.json               the config, with an ETag
+//    GET /config.json?wait=30s      with If-None-Match, held until it changes
+//    PUT /config.json               replace the config
+//
+// Mount it at any path; the Content-Type of PUT is served back.
+type ConfigServer struct {
+    mu          sync.Mutex
+    data        []byte
+    contentType string
+    etag        string
+    changed     chan struct{} // closed and replaced on every change
+}
+
+func NewConfigServer(data []byte, contentType string) *ConfigServer {
+    s := &ConfigServer{changed: make(chan struct{})}
+    s.Set(data, contentType)
+    return s
+}
+
+// Set replaces the config and wakes long-polling clients
+func (s *ConfigServer) Set(data []byte, contentType string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    s.data = data
+    s.contentType = contentType
+    s.etag = configETag(data)
+    close(s.changed)
+    s.changed = make(chan struct{})
+}
+
+func (s *ConfigServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    switch r.Method {
+    case http.MethodGet, http.MethodHead:
+        s.get(w, r)
+    case http.MethodPut:
+        data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        contentType := r.Header.Get("Content-Type")
+        if contentType == "" {
+            contentType = "application/json"
+        }
+        s.Set(data, contentType)
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        w.Header().Set("Allow", "GET, HEAD, PUT")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func (s *ConfigServer) get(w http.ResponseWriter, r *http.Request) {
+    var wait <-chan time.Time
+    if d, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil && d > 0 {
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+        wait = timer.C
+    }
+    
+    for {
+        s.mu.Lock()
+        data, contentType, etag, changed := s.data, s.contentType, s.etag, s.changed
+        s.mu.Unlock()
+        
+        w.Header().Set("ETag", etag)
+        match := r.Header.Get("If-None-Match")
+        if match == "" || !configETagMatches(match, etag) {
+            w.Header().Set("Content-Type", contentType)
+            w.Write(data)
+            return
+        }
+        if wait == nil {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+        
+        select {
+        case <-changed:
+        case <-wait:
+            w.WriteHeader(http.StatusNotModified)
+            return
+        case <-r.Context().Done():
+            return
+        }
+    }
+}
+
+// configETag is a strong ETag for a config body. It and configETagMatches
+// copy computeETag and etagMatches from cache_http.go, which is built into
+// the cache program, not this one.
+func configETag(data []byte) string {
+    sum := sha256.Sum256(data)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// configETagMatches is the weak If-None-Match comparison
+func configETagMatches(header, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+            return true
+        }
+    }
+    return false
+}
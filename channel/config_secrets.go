@@ -0,0 +1,241 @@
+package main
+
+import (
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/rand"
+    "encoding/base64"
+    "errors"
+    "fmt"
+    "os"
+    "reflect"
+    "regexp"
+    "strings"
+)
+
+// String values may contain references that are resolved at load time:
+//
+//    ${env:DB_PASSWORD}       the environment variable
+//    ${file:/run/secrets/db}  the file content, without the trailing newline
+//    ${enc:BASE64}            AES-GCM ciphertext, decrypted with ConfigKeyEnv
+//
+// Fields tagged secret:"true" are redacted in logs, diffs and Explain.
+
+// ConfigKeyEnv holds the base64 AES key (16, 24 or 32 bytes) for ${enc:...}
+const ConfigKeyEnv = "CONFIG_KEY"
+
+const redacted = "[REDACTED]"
+
+var secretRef = regexp.MustCompile(`\$\{(env|file|enc):([^}]*)\}`)
+
+// untrustedSource marks a source that may not reference local secrets.
+// A config server could otherwise read any environment variable or file
+// on this host through a field that is served and logged unredacted.
+type untrustedSource interface {
+    untrusted()
+}
+
+// rejectSecretRefs fails on the first reference in tree
+func rejectSecretRefs(tree map[string]interface{}, prefix string) error {
+    for key, value := range tree {
+        path := joinPath(prefix, key)
+        switch v := value.(type) {
+        case map[string]interface{}:
+            if err := rejectSecretRefs(v, path); err != nil {
+                return err
+            }
+        case string:
+            if secretRef.MatchString(v) {
+                return fmt.Errorf("%s: secret references are only resolved in local sources", path)
+            }
+        }
+    }
+    return nil
+}
+
+// resolveSecrets replaces references in every string of tree
+func resolveSecrets(tree map[string]interface{}, prefix string) error {
+    for key, value := range tree {
+        path := joinPath(prefix, key)
+        switch v := value.(type) {
+        case map[string]interface{}:
+            if err := resolveSecrets(v, path); err != nil {
+                return err
+            }
+        case string:
+            resolved, err := resolveRefs(v)
+            if err != nil {
+                return fmt.Errorf("%s: %w", path, err)
+            }
+            tree[key] = resolved
+        }
+    }
+    return nil
+}
+
+func resolveRefs(s string) (string, error) {
+    var firstErr error
+    resolved := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+        m := secretRef.FindStringSubmatch(ref)
+        value, err := resolveRef(m[1], m[2])
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+        return value
+    })
+    return resolved, firstErr
+}
+
+// resolveRef errors never include the secret itself
+func resolveRef(kind, arg string) (string, error) {
+    switch kind {
+    case "env":
+        value, ok := os.LookupEnv(arg)
+        if !ok {
+            return "", fmt.Errorf("environment variable %s is not set", arg)
+        }
+        return value, nil
+    case "file":
+        data, err := os.ReadFile(arg)
+        if err != nil {
+            return "", fmt.Errorf("secret file: %w", err)
+        }
+        return strings.TrimRight(string(data), "\r\n"), nil
+    default:
+        key, err := configKey()
+        if err != nil {
+            return "", err
+        }
+        return DecryptValue(key, arg)
+    }
+}
+
+func configKey() ([]byte, error) {
+    encoded := os.Getenv(ConfigKeyEnv)
+    if encoded == "" {
+        return nil, fmt.Errorf("encrypted value but %s is not set", ConfigKeyEnv)
+    }
+    key, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return nil, fmt.Errorf("%s is not base64: %w", ConfigKeyEnv, err)
+    }
+    return key, nil
+}
+
+// NewConfigKey returns a random base64 AES-256 key for ConfigKeyEnv
+func NewConfigKey() (string, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return "", err
+    }
+    return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// EncryptValue returns a ${enc:...} reference that decrypts to plaintext
+func EncryptValue(key []byte, plaintext string) (string, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return "", err
+    }
+    
+    nonce := make([]byte, gcm.NonceSize())
+    if _, err := rand.Read(nonce); err != nil {
+        return "", err
+    }
+    sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+    return "${enc:" + base64.StdEncoding.EncodeToString(sealed) + "}", nil
+}
+
+// DecryptValue opens the base64 nonce+ciphertext inside ${enc:...}
+func DecryptValue(key []byte, encoded string) (string, error) {
+    gcm, err := newGCM(key)
+    if err != nil {
+        return "", err
+    }
+    
+    sealed, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return "", fmt.Errorf("encrypted value is not base64: %w", err)
+    }
+    if len(sealed) < gcm.NonceSize() {
+        return "", errors.New("encrypted value is too short")
+    }
+    plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+    if err != nil {
+        return "", errors.New("encrypted value does not decrypt with the configured key")
+    }
+    return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// secretPaths lists the config paths tagged secret:"true"
+func secretPaths(t reflect.Type, prefix string, paths map[string]bool) map[string]bool {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name := jsonName(field)
+        if name == "" {
+            continue
+        }
+        path := joinPath(prefix, name)
+        if field.Type.Kind() == reflect.Struct {
+            secretPaths(field.Type, path, paths)
+        } else if field.Tag.Get("secret") == "true" {
+            paths[path] = true
+        }
+    }
+    return paths
+}
+
+var configSecrets = secretPaths(reflect.TypeOf(Config{}), "", make(map[string]bool))
+
+// isSecret reports whether path is or contains a secret field
+func isSecret(path string) bool {
+    for secret := range configSecrets {
+        if secret == path || strings.HasPrefix(secret, path+".") {
+            return true
+        }
+    }
+    return false
+}
+
+// RedactValue hides value when path is secret. Empty values and bare
+// references like ${env:DB_PASSWORD} stay visible, they give nothing away.
+func RedactValue(path string, value interface{}) interface{} {
+    if !isSecret(path) || value == nil || reflect.ValueOf(value).IsZero() {
+        return value
+    }
+    if s, ok := value.(string); ok && secretRef.ReplaceAllString(s, "") == "" {
+        return value
+    }
+    return redacted
+}
+
+// Redacted returns a copy of config that is safe to log or serve
+func Redacted(config Config) Config {
+    redactStruct(reflect.ValueOf(&config).Elem(), "")
+    return config
+}
+
+func redactStruct(v reflect.Value, prefix string) {
+    for i := 0; i < v.NumField(); i++ {
+        name := jsonName(v.Type().Field(i))
+        if name == "" {
+            continue
+        }
+        path := joinPath(prefix, name)
+        field := v.Field(i)
+        switch {
+        case field.Kind() == reflect.Struct:
+            redactStruct(field, path)
+        case configSecrets[path] && field.Kind() == reflect.String && field.String() != "":
+            field.SetString(redacted)
+        }
+    }
+}
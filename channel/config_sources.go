@@ -0,0 +1,438 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// ConfigSource is one layer of configuration as a tree of nested maps keyed
+// by the json tag names of Config, e.g. {"database": {"port": 5432}}
+type ConfigSource interface {
+    Name() string
+    Load() (map[string]interface{}, error)
+}
+
+// ConfigOrigin says which source supplied the value at Path
+type ConfigOrigin struct {
+    Path   string      `json:"path"`
+    Value  interface{} `json:"value"`
+    Source string      `json:"source"`
+}
+
+func (o ConfigOrigin) String() string {
+    return fmt.Sprintf("%s = %v (from %s)", o.Path, o.Value, o.Source)
+}
+
+// ConfigLoader merges sources in order, later sources overriding earlier
+// ones: defaults, then files, then environment, then flags.
+type ConfigLoader struct {
+    sources []ConfigSource
+}
+
+func NewConfigLoader(sources ...ConfigSource) *ConfigLoader {
+    return &ConfigLoader{sources: sources}
+}
+
+// Files returns the paths of file sources, so they can be watched
+func (l *ConfigLoader) Files() []string {
+    var paths []string
+    for _, source := range l.sources {
+        if fs, ok := source.(*FileSource); ok {
+            paths = append(paths, fs.path)
+        }
+    }
+    return paths
+}
+
+// WatchedSource is a source that announces its own changes, like a remote
+// source learning about a new version
+type WatchedSource interface {
+    ConfigSource
+    Changes() <-chan struct{}
+}
+
+// Watched returns the sources that announce changes
+func (l *ConfigLoader) Watched() []WatchedSource {
+    var watched []WatchedSource
+    for _, source := range l.sources {
+        if ws, ok := source.(WatchedSource); ok {
+            watched = append(watched, ws)
+        }
+    }
+    return watched
+}
+
+// LoadedConfig is one merged load of all sources
+type LoadedConfig struct {
+    Config  Config
+    Origins map[string]ConfigOrigin
+    Hash    string // of the merged sources, before secrets are resolved
+}
+
+// Load merges every source and decodes the result into a Config
+func (l *ConfigLoader) Load() (*LoadedConfig, error) {
+    merged := make(map[string]interface{})
+    origins := make(map[string]ConfigOrigin)
+    
+    for _, source := range l.sources {
+        tree, err := source.Load()
+        if err == nil {
+            if _, ok := source.(untrustedSource); ok {
+                err = rejectSecretRefs(tree, "")
+            }
+        }
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", source.Name(), err)
+        }
+        mergeTree(merged, tree, "", source.Name(), origins)
+    }
+    
+    // json.Marshal sorts map keys, so equal sources hash the same
+    data, err := json.Marshal(merged)
+    if err != nil {
+        return nil, err
+    }
+    sum := sha256.Sum256(data)
+    
+    // Origins keep the references, the config gets the resolved secrets
+    if err := resolveSecrets(merged, ""); err != nil {
+        return nil, err
+    }
+    
+    var config Config
+    if err := decodeTree(merged, reflect.ValueOf(&config).Elem(), ""); err != nil {
+        return nil, err
+    }
+    return &LoadedConfig{Config: config, Origins: origins, Hash: hex.EncodeToString(sum[:8])}, nil
+}
+
+func mergeTree(dst, src map[string]interface{}, prefix, source string, origins map[string]ConfigOrigin) {
+    for key, value := range src {
+        path := joinPath(prefix, key)
+        
+        if child, ok := value.(map[string]interface{}); ok {
+            existing, ok := dst[key].(map[string]interface{})
+            if !ok {
+                existing = make(map[string]interface{})
+                dst[key] = existing
+            }
+            mergeTree(existing, child, path, source, origins)
+            continue
+        }
+        
+        dst[key] = value
+        origins[path] = ConfigOrigin{Path: path, Value: RedactValue(path, value), Source: source}
+    }
+}
+
+func joinPath(prefix, key string) string {
+    if prefix == "" {
+        return key
+    }
+    return prefix + "." + key
+}
+
+// decodeTree copies a merged tree into a struct by json tag, converting
+// strings from env, flags and INI files into the field's type
+func decodeTree(tree interface{}, dst reflect.Value, path string) error {
+    if tree == nil {
+        // An empty value in the file leaves the field as it was
+        return nil
+    }
+    
+    if dst.Kind() == reflect.Map {
+        m, ok := tree.(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("%s: expected a section, got %v", path, tree)
+        }
+        result := reflect.MakeMapWithSize(dst.Type(), len(m))
+        for key, value := range m {
+            elem := reflect.New(dst.Type().Elem()).Elem()
+            if err := decodeTree(value, elem, joinPath(path, key)); err != nil {
+                return err
+            }
+            result.SetMapIndex(reflect.ValueOf(key).Convert(dst.Type().Key()), elem)
+        }
+        dst.Set(result)
+        return nil
+    }
+    
+    if dst.Kind() == reflect.Struct {
+        m, ok := tree.(map[string]interface{})
+        if !ok {
+            return fmt.Errorf("%s: expected a section, got %v", path, tree)
+        }
+        for i := 0; i < dst.NumField(); i++ {
+            name := jsonName(dst.Type().Field(i))
+            if name == "" {
+                continue
+            }
+            if value, ok := m[name]; ok {
+                if err := decodeTree(value, dst.Field(i), joinPath(path, name)); err != nil {
+                    return err
+                }
+            }
+        }
+        return nil
+    }
+    
+    if dst.Kind() == reflect.Slice {
+        items, ok := tree.([]interface{})
+        if !ok {
+            // Comma separated lists from env and flags
+            s := fmt.Sprint(tree)
+            for _, item := range strings.Split(s, ",") {
+                items = append(items, strings.TrimSpace(item))
+            }
+        }
+        slice := reflect.MakeSlice(dst.Type(), len(items), len(items))
+        for i, item := range items {
+            if err := decodeTree(item, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+                return err
+            }
+        }
+        dst.Set(slice)
+        return nil
+    }
+    
+    return setScalar(dst, tree, path)
+}
+
+func setScalar(dst reflect.Value, value interface{}, path string) error {
+    s := fmt.Sprint(value)
+    if f, ok := value.(float64); ok {
+        s = strconv.FormatFloat(f, 'f', -1, 64) // keep 5432 from JSON as "5432"
+    }
+    
+    switch dst.Kind() {
+    case reflect.String:
+        dst.SetString(s)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(s)
+        if err != nil {
+            return fmt.Errorf("%s: %q is not a bool", path, s)
+        }
+        dst.SetBool(b)
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        n, err := strconv.ParseInt(s, 10, 64)
+        if err != nil {
+            return fmt.Errorf("%s: %q is not an integer", path, s)
+        }
+        dst.SetInt(n)
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        n, err := strconv.ParseUint(s, 10, 64)
+        if err != nil {
+            return fmt.Errorf("%s: %q is not an unsigned integer", path, s)
+        }
+        dst.SetUint(n)
+    case reflect.Float32, reflect.Float64:
+        f, err := strconv.ParseFloat(s, 64)
+        if err != nil {
+            return fmt.Errorf("%s: %q is not a number", path, s)
+        }
+        dst.SetFloat(f)
+    default:
+        return fmt.Errorf("%s: unsupported type %s", path, dst.Type())
+    }
+    return nil
+}
+
+func jsonName(field reflect.StructField) string {
+    if !field.IsExported() {
+        return ""
+    }
+    tag := strings.Split(field.Tag.Get("json"), ",")[0]
+    if tag == "-" {
+        return ""
+    }
+    if tag == "" {
+        return field.Name
+    }
+    return tag
+}
+
+// configPaths lists every leaf path of Config, e.g. "database.host". Maps
+// such as flags have no fixed paths and are left to files.
+func configPaths(t reflect.Type, prefix string) []string {
+    var paths []string
+    for i := 0; i < t.NumField(); i++ {
+        name := jsonName(t.Field(i))
+        if name == "" {
+            continue
+        }
+        path := joinPath(prefix, name)
+        if t.Field(i).Type.Kind() == reflect.Struct {
+            paths = append(paths, configPaths(t.Field(i).Type, path)...)
+            continue
+        }
+        if t.Field(i).Type.Kind() == reflect.Map {
+            continue
+        }
+        paths = append(paths, path)
+    }
+    sort.Strings(paths)
+    return paths
+}
+
+// mapKeys returns the keys of a string keyed map in order
+func mapKeys(v reflect.Value) []string {
+    keys := make([]string, 0, v.Len())
+    for _, key := range v.MapKeys() {
+        keys = append(keys, key.String())
+    }
+    sort.Strings(keys)
+    return keys
+}
+
+// setPath stores value at a dotted path, creating sections on the way
+func setPath(tree map[string]interface{}, path string, value interface{}) {
+    parts := strings.Split(path, ".")
+    for _, part := range parts[:len(parts)-1] {
+        child, ok := tree[part].(map[string]interface{})
+        if !ok {
+            child = make(map[string]interface{})
+            tree[part] = child
+        }
+        tree = child
+    }
+    tree[parts[len(parts)-1]] = value
+}
+
+// DefaultsSource supplies the values a Config starts with
+type DefaultsSource struct {
+    defaults Config
+}
+
+func NewDefaultsSource(defaults Config) *DefaultsSource {
+    return &DefaultsSource{defaults: defaults}
+}
+
+func (s *DefaultsSource) Name() string {
+    return "defaults"
+}
+
+func (s *DefaultsSource) Load() (map[string]interface{}, error) {
+    data, err := json.Marshal(s.defaults)
+    if err != nil {
+        return nil, err
+    }
+    var tree map[string]interface{}
+    err = json.Unmarshal(data, &tree)
+    return tree, err
+}
+
+// FileSource reads a JSON, YAML, TOML or INI file, picked by extension
+type FileSource struct {
+    path     string
+    optional bool
+}
+
+func NewFileSource(path string) *FileSource {
+    return &FileSource{path: path}
+}
+
+// NewOptionalFileSource is a FileSource that is skipped when the file is missing
+func NewOptionalFileSource(path string) *FileSource {
+    return &FileSource{path: path, optional: true}
+}
+
+func (s *FileSource) Name() string {
+    return "file " + s.path
+}
+
+func (s *FileSource) Load() (map[string]interface{}, error) {
+    data, err := os.ReadFile(s.path)
+    if err != nil {
+        if s.optional && os.IsNotExist(err) {
+            return nil, nil
+        }
+        return nil, err
+    }
+    
+    return parseConfigData(strings.TrimPrefix(filepath.Ext(s.path), "."), data)
+}
+
+// parseConfigData parses data by format, a file extension or media type
+// suffix such as "yaml" or "toml"; anything else is JSON
+func parseConfigData(format string, data []byte) (map[string]interface{}, error) {
+    switch strings.ToLower(format) {
+    case "yaml", "yml", "x-yaml":
+        return parseYAML(data)
+    case "toml":
+        return parseTOML(data)
+    case "ini", "conf":
+        return parseINI(data)
+    default:
+        var tree map[string]interface{}
+        err := json.Unmarshal(data, &tree)
+        return tree, err
+    }
+}
+
+// EnvSource maps PREFIX_SECTION_KEY variables onto config paths, e.g.
+// APP_DATABASE_HOST to database.host and APP_API_RATE_LIMIT to api.rate_limit
+type EnvSource struct {
+    prefix string
+}
+
+func NewEnvSource(prefix string) *EnvSource {
+    return &EnvSource{prefix: prefix}
+}
+
+func (s *EnvSource) Name() string {
+    return "env " + s.prefix + "_*"
+}
+
+// EnvName is the variable that sets path
+func (s *EnvSource) EnvName(path string) string {
+    return s.prefix + "_" + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+func (s *EnvSource) Load() (map[string]interface{}, error) {
+    tree := make(map[string]interface{})
+    for _, path := range configPaths(reflect.TypeOf(Config{}), "") {
+        if value, ok := os.LookupEnv(s.EnvName(path)); ok {
+            setPath(tree, path, value)
+        }
+    }
+    return tree, nil
+}
+
+// FlagSource exposes every config path as a flag, e.g. -database.port=5433.
+// Only flags given on the command line override other sources.
+type FlagSource struct {
+    fs     *flag.FlagSet
+    values map[string]*string
+}
+
+// NewFlagSource registers the config flags on fs; call fs.Parse afterwards
+func NewFlagSource(fs *flag.FlagSet) *FlagSource {
+    s := &FlagSource{fs: fs, values: make(map[string]*string)}
+    for _, path := range configPaths(reflect.TypeOf(Config{}), "") {
+        s.values[path] = fs.String(path, "", "config override for "+path)
+    }
+    return s
+}
+
+func (s *FlagSource) Name() string {
+    return "flags"
+}
+
+func (s *FlagSource) Load() (map[string]interface{}, error) {
+    tree := make(map[string]interface{})
+    s.fs.Visit(func(f *flag.Flag) {
+        if value, ok := s.values[f.Name]; ok {
+            setPath(tree, f.Name, *value)
+        }
+    })
+    return tree, nil
+}
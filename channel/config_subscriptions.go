@@ -0,0 +1,244 @@
+package main
+
+import (
+    "context"
+    "reflect"
+)
+
+// Every subscriber channel holds at most one value. When a subscriber has
+// not read the previous value yet it is replaced with the newest one, so a
+// slow subscriber skips intermediate versions but always ends on the latest.
+
+// SubscriptionStats counts deliveries across all subscribers
+type SubscriptionStats struct {
+    Subscribers int    `json:"subscribers"`
+    Delivered   uint64 `json:"delivered"`
+    Coalesced   uint64 `json:"coalesced"` // replaced before the subscriber read them
+    Dropped     uint64 `json:"dropped"`   // still unread when the subscriber went away
+}
+
+// configSubscription is one registered channel; exactly one of configs,
+// updates and errs is set
+type configSubscription struct {
+    configs chan Config
+    updates chan ConfigUpdate
+    errs    chan error
+    paths   []string
+    since   uint64 // snapshot version the subscription started from
+    stop    chan struct{}
+}
+
+func (s *configSubscription) pending() int {
+    return len(s.configs) + len(s.updates) + len(s.errs)
+}
+
+func (s *configSubscription) close() {
+    close(s.stop)
+    switch {
+    case s.configs != nil:
+        close(s.configs)
+    case s.updates != nil:
+        close(s.updates)
+    case s.errs != nil:
+        close(s.errs)
+    }
+}
+
+// Subscribe receives the current config immediately and every new version
+// after it. The channel is closed when ctx is done or on Unsubscribe.
+func (cm *ConfigManager) Subscribe(ctx context.Context) <-chan Config {
+    ch := make(chan Config, 1)
+    cm.register(ctx, (<-chan Config)(ch), &configSubscription{configs: ch})
+    return ch
+}
+
+// SubscribeChanges receives only updates that touch the given paths or
+// sections, e.g. "database" or "api.timeout", with just those changes.
+// Coalesced updates are merged, so Old is the value last delivered.
+func (cm *ConfigManager) SubscribeChanges(ctx context.Context, paths ...string) <-chan ConfigUpdate {
+    _, ch := cm.SubscribeChangesFrom(ctx, paths...)
+    return ch
+}
+
+// SubscribeChangesFrom is SubscribeChanges that also returns the config the
+// updates start from. Initializing from it instead of GetCurrent leaves no
+// gap in which a change could be missed.
+func (cm *ConfigManager) SubscribeChangesFrom(ctx context.Context, paths ...string) (Config, <-chan ConfigUpdate) {
+    ch := make(chan ConfigUpdate, 1)
+    current := cm.register(ctx, (<-chan ConfigUpdate)(ch), &configSubscription{updates: ch, paths: paths})
+    return current, ch
+}
+
+// SubscribeErrors receives the errors of rejected reloads. Like every
+// subscription it holds one value: errors are not queued, and when several
+// reloads fail before the reader receives, only the latest is delivered and
+// the others count as Coalesced in Stats.
+func (cm *ConfigManager) SubscribeErrors(ctx context.Context) <-chan error {
+    ch := make(chan error, 1)
+    cm.register(ctx, (<-chan error)(ch), &configSubscription{errs: ch})
+    return ch
+}
+
+// register adds sub and returns the config it starts from; a config
+// subscription gets that config as its first value. Both happen under
+// cm.mu, which apply also holds, so no version can fall in between. A
+// version published but not yet applied is skipped by notify via since.
+func (cm *ConfigManager) register(ctx context.Context, key interface{}, sub *configSubscription) Config {
+    sub.stop = make(chan struct{})
+    
+    cm.mu.Lock()
+    snapshot := cm.manager.Snapshot()
+    current := snapshot.Value.Config
+    sub.since = snapshot.Version
+    if sub.configs != nil {
+        sub.configs <- current
+        cm.stats.Delivered++
+    }
+    cm.subscriptions[key] = sub
+    cm.mu.Unlock()
+    
+    go func() {
+        select {
+        case <-ctx.Done():
+            cm.Unsubscribe(key)
+        case <-sub.stop:
+        }
+    }()
+    
+    return current
+}
+
+// Unsubscribe closes a channel returned by Subscribe, SubscribeChanges or
+// SubscribeErrors; unknown or already closed channels are ignored
+func (cm *ConfigManager) Unsubscribe(ch interface{}) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    sub, ok := cm.subscriptions[ch]
+    if !ok {
+        return
+    }
+    delete(cm.subscriptions, ch)
+    cm.stats.Dropped += uint64(sub.pending())
+    sub.close()
+}
+
+// Stats reports subscriber counts and delivery counters
+func (cm *ConfigManager) Stats() SubscriptionStats {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    stats := cm.stats
+    stats.Subscribers = len(cm.subscriptions)
+    return stats
+}
+
+// notify delivers a new version; the caller holds cm.mu, which is also what
+// makes replacing an unread value safe, since only the subscriber can
+// receive concurrently
+func (cm *ConfigManager) notify(config Config, changes []ConfigChange, version uint64) {
+    for _, sub := range cm.subscriptions {
+        if sub.since >= version {
+            continue
+        }
+        switch {
+        case sub.configs != nil:
+            cm.offerConfig(sub.configs, config)
+        case sub.updates != nil:
+            if relevant := filterChanges(changes, sub.paths); len(relevant) > 0 {
+                cm.offerUpdate(sub.updates, ConfigUpdate{Config: config, Changes: relevant})
+            }
+        }
+    }
+}
+
+func (cm *ConfigManager) reportError(err error) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    
+    for _, sub := range cm.subscriptions {
+        if sub.errs != nil {
+            cm.offerError(sub.errs, err)
+        }
+    }
+}
+
+func (cm *ConfigManager) offerConfig(ch chan Config, config Config) {
+    for {
+        select {
+        case ch <- config:
+            cm.stats.Delivered++
+            return
+        default:
+        }
+        select {
+        case <-ch:
+            cm.stats.Coalesced++
+        default:
+        }
+    }
+}
+
+func (cm *ConfigManager) offerUpdate(ch chan ConfigUpdate, update ConfigUpdate) {
+    for {
+        select {
+        case ch <- update:
+            cm.stats.Delivered++
+            return
+        default:
+        }
+        select {
+        case unread := <-ch:
+            cm.stats.Coalesced++
+            update.Changes = mergeChanges(unread.Changes, update.Changes)
+            if len(update.Changes) == 0 {
+                // The value went back to what the subscriber last saw
+                return
+            }
+        default:
+        }
+    }
+}
+
+func (cm *ConfigManager) offerError(ch chan error, err error) {
+    for {
+        select {
+        case ch <- err:
+            cm.stats.Delivered++
+            return
+        default:
+        }
+        select {
+        case <-ch:
+            cm.stats.Coalesced++
+        default:
+        }
+    }
+}
+
+// mergeChanges folds two consecutive diffs into one, keeping the older Old
+// and the newer New, and dropping paths that ended where they started.
+// Redacted secrets cannot be compared, so they are always kept.
+func mergeChanges(older, newer []ConfigChange) []ConfigChange {
+    merged := make([]ConfigChange, 0, len(older)+len(newer))
+    index := make(map[string]int)
+    for _, change := range older {
+        index[change.Path] = len(merged)
+        merged = append(merged, change)
+    }
+    for _, change := range newer {
+        if i, ok := index[change.Path]; ok {
+            merged[i].New = change.New
+            continue
+        }
+        merged = append(merged, change)
+    }
+    
+    result := merged[:0]
+    for _, change := range merged {
+        if change.Secret || !reflect.DeepEqual(change.Old, change.New) {
+            result = append(result, change)
+        }
+    }
+    return result
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "reflect"
+    "strconv"
+    "strings"
+)
+
+// Config fields are checked against their validate tag, a comma separated
+// list of rules: required, min=N, max=N, oneof=a b c
+
+// ValidationError is one failed rule at a config path
+type ValidationError struct {
+    Path    string
+    Message string
+}
+
+func (e ValidationError) Error() string {
+    return e.Path + ": " + e.Message
+}
+
+// ValidationErrors collects every failure of one config
+type ValidationErrors []ValidationError
+
+func (errs ValidationErrors) Error() string {
+    messages := make([]string, len(errs))
+    for i, err := range errs {
+        messages[i] = err.Error()
+    }
+    return "invalid config: " + strings.Join(messages, "; ")
+}
+
+// ConfigValidator checks rules that span fields or need outside knowledge
+type ConfigValidator func(Config) error
+
+// ValidateConfig runs the tag rules and then every custom validator
+func ValidateConfig(config Config, validators ...ConfigValidator) error {
+    var errs ValidationErrors
+    validateStruct(reflect.ValueOf(config), "", &errs)
+    
+    for _, validator := range validators {
+        err := validator(config)
+        var verrs ValidationErrors
+        var verr ValidationError
+        switch {
+        case err == nil:
+        case errors.As(err, &verrs):
+            errs = append(errs, verrs...)
+        case errors.As(err, &verr):
+            errs = append(errs, verr)
+        default:
+            errs = append(errs, ValidationError{Path: "config", Message: err.Error()})
+        }
+    }
+    
+    if len(errs) > 0 {
+        return errs
+    }
+    return nil
+}
+
+func validateStruct(v reflect.Value, prefix string, errs *ValidationErrors) {
+    for i := 0; i < v.NumField(); i++ {
+        field := v.Type().Field(i)
+        name := jsonName(field)
+        if name == "" {
+            continue
+        }
+        path := joinPath(prefix, name)
+        
+        if field.Type.Kind() == reflect.Struct {
+            validateStruct(v.Field(i), path, errs)
+            continue
+        }
+        if field.Type.Kind() == reflect.Map && field.Type.Elem().Kind() == reflect.Struct {
+            for _, key := range mapKeys(v.Field(i)) {
+                validateStruct(v.Field(i).MapIndex(reflect.ValueOf(key)), joinPath(path, key), errs)
+            }
+            continue
+        }
+        
+        tag := field.Tag.Get("validate")
+        if tag == "" {
+            continue
+        }
+        shown := fmt.Sprint(RedactValue(path, v.Field(i).Interface()))
+        for _, rule := range strings.Split(tag, ",") {
+            if msg := checkRule(v.Field(i), rule, shown); msg != "" {
+                *errs = append(*errs, ValidationError{Path: path, Message: msg})
+            }
+        }
+    }
+}
+
+// checkRule returns a message when value breaks rule; shown is the value
+// as it may appear in the message
+func checkRule(value reflect.Value, rule string, shown string) string {
+    name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+    
+    switch name {
+    case "required":
+        if value.IsZero() {
+            return "is required"
+        }
+    case "min", "max":
+        limit, err := strconv.ParseFloat(arg, 64)
+        if err != nil {
+            return fmt.Sprintf("bad rule %q", rule)
+        }
+        n, ok := ruleNumber(value)
+        if !ok {
+            return fmt.Sprintf("rule %q does not apply to %s", rule, value.Type())
+        }
+        if name == "min" && n < limit {
+            return fmt.Sprintf("must be at least %v, got %v", arg, shown)
+        }
+        if name == "max" && n > limit {
+            return fmt.Sprintf("must be at most %v, got %v", arg, shown)
+        }
+    case "oneof":
+        for _, option := range strings.Fields(arg) {
+            if fmt.Sprint(value.Interface()) == option {
+                return ""
+            }
+        }
+        return fmt.Sprintf("must be one of [%s], got %q", arg, shown)
+    default:
+        return fmt.Sprintf("unknown rule %q", rule)
+    }
+    return ""
+}
+
+// ruleNumber is the number min and max compare: the value for numbers,
+// the length for strings and lists
+func ruleNumber(value reflect.Value) (float64, bool) {
+    switch value.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(value.Int()), true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(value.Uint()), true
+    case reflect.Float32, reflect.Float64:
+        return value.Float(), true
+    case reflect.String, reflect.Slice, reflect.Map:
+        return float64(value.Len()), true
+    }
+    return 0, false
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "database/sql/driver"
+    "errors"
+    "io"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// FakeDriver is an in-memory sql driver for exercising DatabaseManager
+// without a database. Connections to hosts marked down fail.
+type FakeDriver struct {
+    mu     sync.Mutex
+    down   map[string]bool
+    opened int64
+    closed int64
+}
+
+// RegisterFakeDriver registers a FakeDriver under name, for DatabaseOptions.Driver
+func RegisterFakeDriver(name string) *FakeDriver {
+    d := &FakeDriver{down: make(map[string]bool)}
+    sql.Register(name, d)
+    return d
+}
+
+// SetDown makes new connections to host fail, or succeed again
+func (d *FakeDriver) SetDown(host string, down bool) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.down[host] = down
+}
+
+// OpenConns reports how many connections are currently open
+func (d *FakeDriver) OpenConns() int64 {
+    return atomic.LoadInt64(&d.opened) - atomic.LoadInt64(&d.closed)
+}
+
+func (d *FakeDriver) OpenConnector(dsn string) (driver.Connector, error) {
+    return &fakeConnector{driver: d, host: dsnValue(dsn, "host")}, nil
+}
+
+func (d *FakeDriver) Open(dsn string) (driver.Conn, error) {
+    return (&fakeConnector{driver: d, host: dsnValue(dsn, "host")}).Connect(context.Background())
+}
+
+// dsnValue reads one key from a key=value DSN as DSN writes it
+func dsnValue(dsn, key string) string {
+    for _, field := range strings.Fields(dsn) {
+        if k, v, ok := strings.Cut(field, "="); ok && k == key {
+            return strings.Trim(v, "'")
+        }
+    }
+    return ""
+}
+
+type fakeConnector struct {
+    driver *FakeDriver
+    host   string
+}
+
+func (c *fakeConnector) Connect(ctx context.Context) (driver.Conn, error) {
+    c.driver.mu.Lock()
+    down := c.driver.down[c.host]
+    c.driver.mu.Unlock()
+    if down {
+        return nil, errors.New("fake driver: connection refused by " + c.host)
+    }
+    
+    atomic.AddInt64(&c.driver.opened, 1)
+    return &fakeConn{driver: c.driver}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver {
+    return c.driver
+}
+
+// fakeConn accepts any statement and returns no rows
+type fakeConn struct {
+    driver *FakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+    return fakeStmt{}, nil
+}
+
+func (c *fakeConn) Close() error {
+    atomic.AddInt64(&c.driver.closed, 1)
+    return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+    return fakeTx{}, nil
+}
+
+func (c *fakeConn) Ping(ctx context.Context) error {
+    return nil
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+    return driver.RowsAffected(0), nil
+}
+
+func (fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+    return fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string              { return nil }
+func (fakeRows) Close() error                   { return nil }
+func (fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
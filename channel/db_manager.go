@@ -0,0 +1,240 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    
+    _ "github.com/lib/pq"
+)
+
+var ErrDatabaseClosed = errors.New("database manager closed")
+
+// DatabaseOptions configures how DatabaseManager opens and swaps pools
+type DatabaseOptions struct {
+    Driver        string        // sql driver name, "postgres" by default
+    VerifyTimeout time.Duration // for the ping of a new pool, 5s by default
+}
+
+// DatabaseStats describes the current pool and past swaps
+type DatabaseStats struct {
+    Generation  int            `json:"generation"`
+    Config      DatabaseConfig `json:"config"`   // redacted
+    InUse       int64          `json:"in_use"`   // borrowers of the current pool
+    Draining    int            `json:"draining"` // old pools waiting for borrowers
+    Swaps       int            `json:"swaps"`
+    FailedSwaps int            `json:"failed_swaps"`
+    LastError   string         `json:"last_error,omitempty"`
+}
+
+// dbPool is one generation of connections; borrowers keeps it open
+// until the last query on it finished
+type dbPool struct {
+    db         *sql.DB
+    config     DatabaseConfig
+    generation int
+    borrowers  sync.WaitGroup
+    inUse      int64
+}
+
+// DatabaseManager owns the connection pool and replaces it when the
+// database section of the config changes. A new pool only replaces the old
+// one after it answered a ping; otherwise the old pool stays in use.
+type DatabaseManager struct {
+    opts       DatabaseOptions
+    configChan <-chan ConfigUpdate
+    swapMu     sync.Mutex
+    
+    mu          sync.RWMutex
+    pool        *dbPool
+    closed      bool
+    draining    int
+    swaps       int
+    failedSwaps int
+    lastErr     error
+    drained     sync.WaitGroup
+}
+
+// NewDatabaseManager opens the initial pool and follows database changes
+// until ctx is done
+func NewDatabaseManager(ctx context.Context, cm *ConfigManager, opts DatabaseOptions) (*DatabaseManager, error) {
+    if opts.Driver == "" {
+        opts.Driver = "postgres"
+    }
+    if opts.VerifyTimeout <= 0 {
+        opts.VerifyTimeout = 5 * time.Second
+    }
+    
+    // Subscribe before opening so a change made meanwhile is not missed
+    current, updates := cm.SubscribeChangesFrom(ctx, "database")
+    
+    dm := &DatabaseManager{opts: opts, configChan: updates}
+    pool, err := dm.open(ctx, current.Database, 1)
+    if err != nil {
+        cm.Unsubscribe(updates)
+        return nil, err
+    }
+    dm.pool = pool
+    
+    go dm.handleConfigUpdates(ctx)
+    
+    return dm, nil
+}
+
+func (dm *DatabaseManager) handleConfigUpdates(ctx context.Context) {
+    // Only database changes arrive here; the channel closes with ctx
+    for update := range dm.configChan {
+        log.Printf("Database config changed %v, reconnecting...", update.Changes)
+        if err := dm.Swap(ctx, update.Config.Database); err != nil {
+            log.Printf("Error reconnecting, keeping current pool: %v", err)
+        }
+    }
+    dm.Close()
+}
+
+// DSN renders config as a lib/pq connection string
+func DSN(config DatabaseConfig) string {
+    quote := func(s string) string {
+        return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+    }
+    return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+        quote(config.Host), config.Port, quote(config.User), quote(config.Password), quote(config.Name))
+}
+
+// open creates and verifies a pool for config
+func (dm *DatabaseManager) open(ctx context.Context, config DatabaseConfig, generation int) (*dbPool, error) {
+    db, err := sql.Open(dm.opts.Driver, DSN(config))
+    if err != nil {
+        return nil, err
+    }
+    db.SetMaxOpenConns(config.MaxConns)
+    db.SetMaxIdleConns(config.MaxConns)
+    
+    ctx, cancel := context.WithTimeout(ctx, dm.opts.VerifyTimeout)
+    defer cancel()
+    if err := db.PingContext(ctx); err != nil {
+        db.Close()
+        return nil, fmt.Errorf("connecting to %s:%d: %w", config.Host, config.Port, err)
+    }
+    return &dbPool{db: db, config: config, generation: generation}, nil
+}
+
+// Swap replaces the pool with one for config. The old pool closes once its
+// borrowers are done. If the new pool cannot connect, the old one is kept.
+func (dm *DatabaseManager) Swap(ctx context.Context, config DatabaseConfig) error {
+    dm.swapMu.Lock()
+    defer dm.swapMu.Unlock()
+    
+    dm.mu.RLock()
+    generation := dm.pool.generation + 1
+    dm.mu.RUnlock()
+    
+    pool, err := dm.open(ctx, config, generation)
+    
+    dm.mu.Lock()
+    defer dm.mu.Unlock()
+    
+    if err != nil {
+        dm.failedSwaps++
+        dm.lastErr = err
+        return err
+    }
+    if dm.closed {
+        pool.db.Close()
+        return ErrDatabaseClosed
+    }
+    
+    old := dm.pool
+    dm.pool = pool
+    dm.swaps++
+    dm.lastErr = nil
+    dm.retire(old)
+    
+    log.Printf("Database pool swapped to generation %d (%s:%d)", pool.generation, config.Host, config.Port)
+    return nil
+}
+
+// retire closes pool after its borrowers return it; the caller holds dm.mu
+func (dm *DatabaseManager) retire(pool *dbPool) {
+    dm.draining++
+    dm.drained.Add(1)
+    go func() {
+        defer dm.drained.Done()
+        pool.borrowers.Wait()
+        pool.db.Close()
+        
+        dm.mu.Lock()
+        dm.draining--
+        dm.mu.Unlock()
+        log.Printf("Database pool generation %d drained and closed", pool.generation)
+    }()
+}
+
+// Borrow returns the current pool; call release when done with it, so a
+// swap can close the pool afterwards
+func (dm *DatabaseManager) Borrow() (db *sql.DB, release func(), err error) {
+    dm.mu.RLock()
+    defer dm.mu.RUnlock()
+    
+    if dm.closed {
+        return nil, nil, ErrDatabaseClosed
+    }
+    pool := dm.pool
+    pool.borrowers.Add(1)
+    atomic.AddInt64(&pool.inUse, 1)
+    
+    var once sync.Once
+    release = func() {
+        once.Do(func() {
+            atomic.AddInt64(&pool.inUse, -1)
+            pool.borrowers.Done()
+        })
+    }
+    return pool.db, release, nil
+}
+
+// WithDB runs fn with the current pool borrowed
+func (dm *DatabaseManager) WithDB(fn func(*sql.DB) error) error {
+    db, release, err := dm.Borrow()
+    if err != nil {
+        return err
+    }
+    defer release()
+    return fn(db)
+}
+
+func (dm *DatabaseManager) Stats() DatabaseStats {
+    dm.mu.RLock()
+    defer dm.mu.RUnlock()
+    
+    stats := DatabaseStats{
+        Generation:  dm.pool.generation,
+        Config:      Redacted(Config{Database: dm.pool.config}).Database,
+        InUse:       atomic.LoadInt64(&dm.pool.inUse),
+        Draining:    dm.draining,
+        Swaps:       dm.swaps,
+        FailedSwaps: dm.failedSwaps,
+    }
+    if dm.lastErr != nil {
+        stats.LastError = dm.lastErr.Error()
+    }
+    return stats
+}
+
+// Close stops handing out the pool and waits until every pool drained
+func (dm *DatabaseManager) Close() {
+    dm.mu.Lock()
+    if !dm.closed {
+        dm.closed = true
+        dm.retire(dm.pool)
+    }
+    dm.mu.Unlock()
+    
+    dm.drained.Wait()
+}
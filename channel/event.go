@@ -1,138 +1,211 @@
 package main
 
 import (
-    "encoding/json"
+    "fmt"
     "log"
-    "os"
-    "time"
+    "sort"
+    "strings"
+    "sync"
+    
+    "github.com/harshithgowdakt/learn-go/config"
+    "github.com/harshithgowdakt/learn-go/filewatch"
 )
 
 type Config struct {
-    Database DatabaseConfig `json:"database"`
-    API      APIConfig      `json:"api"`
+    Database DatabaseConfig            `json:"database"`
+    API      APIConfig                 `json:"api"`
+    Flags    map[string]FlagDefinition `json:"flags"`
 }
 
 type DatabaseConfig struct {
-    Host string `json:"host"`
-    Port int    `json:"port"`
+    Host     string `json:"host" validate:"required"`
+    Port     int    `json:"port" validate:"min=1,max=65535"`
+    User     string `json:"user"`
+    Password string `json:"password" secret:"true"`
+    Name     string `json:"name" validate:"required"`
+    MaxConns int    `json:"max_conns" validate:"min=1"`
 }
 
 type APIConfig struct {
-    RateLimit int `json:"rate_limit"`
-    Timeout   int `json:"timeout"`
+    RateLimit int `json:"rate_limit" validate:"min=0"`
+    Timeout   int `json:"timeout" validate:"min=1"`
+}
+
+// DefaultConfig is the lowest precedence layer
+var DefaultConfig = Config{
+    Database: DatabaseConfig{Host: "localhost", Port: 5432, User: "postgres", Name: "postgres", MaxConns: 10},
+    API:      APIConfig{RateLimit: 100, Timeout: 30},
 }
 
+// ConfigManager builds on config.Manager, which loads, validates and
+// publishes snapshots and owns the watchers. Origins, history, diffs and
+// subscriptions are layered on top through its OnChange callback.
 type ConfigManager struct {
-    configPath    string
-    configUpdates chan Config
-    subscribers   []chan Config
-    current       Config
+    loader     *ConfigLoader
+    validators []ConfigValidator
+    manager    *config.Manager[appliedConfig]
+    
+    mu            sync.Mutex
+    applied       *config.Snapshot[appliedConfig] // last one history and subscribers saw
+    subscriptions map[interface{}]*configSubscription
+    stats         SubscriptionStats
+    history       []ConfigVersion
+}
+
+// appliedConfig is one published config along with where its values came
+// from and, for a rollback, the version it restored
+type appliedConfig struct {
+    LoadedConfig
+    rollbackOf int
+}
+
+// NewConfigManager layers defaults, the config file and APP_* environment
+// variables, in increasing precedence
+func NewConfigManager(configPath string) (*ConfigManager, error) {
+    return NewConfigManagerWithLoader(NewConfigLoader(
+        NewDefaultsSource(DefaultConfig),
+        NewFileSource(configPath),
+        NewEnvSource("APP"),
+    ))
 }
 
-func NewConfigManager(configPath string) *ConfigManager {
+// NewConfigManagerWithLoader takes any set of sources, e.g. with flags on
+// top, and custom validators that run after the validate tags. It fails if
+// the initial config does not load or validate, since there is no last good
+// config to fall back to yet. The manager owns the watched sources from
+// here on and closes them on Close or when it fails.
+func NewConfigManagerWithLoader(loader *ConfigLoader, validators ...ConfigValidator) (*ConfigManager, error) {
     cm := &ConfigManager{
-        configPath:    configPath,
-        configUpdates: make(chan Config),
-        subscribers:   make([]chan Config, 0),
+        loader:        loader,
+        validators:    validators,
+        subscriptions: make(map[interface{}]*configSubscription),
     }
     
-    // Load initial config
-    cm.loadConfig()
+    var watchers []config.Watcher
+    for _, path := range loader.Files() {
+        watcher, err := config.FileWatcher(path, filewatch.Options{})
+        if err != nil {
+            log.Printf("Error watching config: %v", err)
+            continue
+        }
+        watchers = append(watchers, watcher)
+    }
+    for _, source := range loader.Watched() {
+        watchers = append(watchers, sourceWatcher{source})
+    }
     
-    // Start config manager
-    go cm.run()
+    // Load initial config before anyone can subscribe
+    manager, err := config.New(config.Options[appliedConfig]{
+        Load:     cm.load,
+        Validate: cm.validate,
+        Watchers: watchers,
+        OnError:  cm.reloadFailed,
+    })
+    if err != nil {
+        return nil, fmt.Errorf("loading initial config: %w", err)
+    }
+    cm.manager = manager
     
-    // Start file watcher
-    go cm.watchFile()
+    cm.mu.Lock()
+    cm.applied = manager.Snapshot()
+    cm.record(&cm.applied.Value.LoadedConfig, nil, 0)
+    cm.mu.Unlock()
     
-    return cm
-}
-
-func (cm *ConfigManager) run() {
-    for newConfig := range cm.configUpdates {
-        cm.current = newConfig
-        log.Println("Configuration updated")
-        
-        // Notify all subscribers
-        for _, subscriber := range cm.subscribers {
-            select {
-            case subscriber <- newConfig:
-                // Sent successfully
-            default:
-                // Subscriber not ready, skip
-                log.Println("Subscriber not ready for config update")
-            }
-        }
+    // A watcher may already have reloaded before OnChange was registered;
+    // apply catches up with whatever is current now
+    manager.OnChange(cm.apply)
+    cm.apply(nil, manager.Snapshot())
+    
+    return cm, nil
+}
+
+// sourceWatcher reloads when a watched source changes and closes the
+// source, e.g. stops a RemoteSource poller, along with the manager
+type sourceWatcher struct {
+    WatchedSource
+}
+
+func (w sourceWatcher) Close() error {
+    if closer, ok := w.WatchedSource.(interface{ Close() }); ok {
+        closer.Close()
     }
+    return nil
 }
 
-func (cm *ConfigManager) loadConfig() {
-    data, err := os.ReadFile(cm.configPath)
+// load merges all sources, remembering where each value came from. A load
+// from the sources ends any rollback.
+func (cm *ConfigManager) load() (*appliedConfig, error) {
+    loaded, err := cm.loader.Load()
     if err != nil {
-        log.Printf("Error reading config: %v", err)
-        return
+        return nil, err
     }
+    return &appliedConfig{LoadedConfig: *loaded}, nil
+}
+
+func (cm *ConfigManager) validate(c *appliedConfig) error {
+    return ValidateConfig(c.Config, cm.validators...)
+}
+
+// reloadFailed keeps the last good config and reports why
+func (cm *ConfigManager) reloadFailed(err error) {
+    log.Printf("Error loading config, keeping last good config: %v", err)
+    cm.reportError(err)
+}
+
+// apply records a published snapshot in history and notifies subscribers
+// when anything changed. Snapshots it has already seen are ignored.
+func (cm *ConfigManager) apply(_, new *config.Snapshot[appliedConfig]) {
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
     
-    var config Config
-    if err := json.Unmarshal(data, &config); err != nil {
-        log.Printf("Error parsing config: %v", err)
+    if new.Version <= cm.applied.Version {
         return
     }
+    old := cm.applied
+    cm.applied = new
     
-    select {
-    case cm.configUpdates <- config:
-        // Config update sent
-    default:
-        // Channel full, skip
+    changes := DiffConfig(old.Value.Config, new.Value.Config)
+    if len(changes) == 0 {
+        return
     }
-}
-
-func (cm *ConfigManager) watchFile() {
-    ticker := time.NewTicker(5 * time.Second)
-    defer ticker.Stop()
-    
-    for range ticker.C {
-        cm.loadConfig()
+    version := cm.record(&new.Value.LoadedConfig, changes, new.Value.rollbackOf)
+    for _, change := range changes {
+        log.Printf("Configuration updated to v%d: %s", version, change)
     }
-}
-
-func (cm *ConfigManager) Subscribe() <-chan Config {
-    subscriber := make(chan Config, 1)
-    cm.subscribers = append(cm.subscribers, subscriber)
     
-    // Send current config immediately
-    subscriber <- cm.current
-    
-    return subscriber
+    // Notify all subscribers
+    cm.notify(new.Value.Config, changes, new.Version)
 }
 
+// GetCurrent returns the current config without locking
 func (cm *ConfigManager) GetCurrent() Config {
-    return cm.current
+    return cm.manager.Get().Config
 }
 
-// Usage - Database connection manager
-type DatabaseManager struct {
-    config     Config
-    configChan <-chan Config
-}
-
-func NewDatabaseManager(cm *ConfigManager) *DatabaseManager {
-    dm := &DatabaseManager{
-        config:     cm.GetCurrent(),
-        configChan: cm.Subscribe(),
-    }
+// Close stops the watchers and the sources they follow and closes every
+// subscription channel. GetCurrent keeps returning the last config.
+func (cm *ConfigManager) Close() error {
+    err := cm.manager.Close()
     
-    go dm.handleConfigUpdates()
-    
-    return dm
+    cm.mu.Lock()
+    defer cm.mu.Unlock()
+    for key, sub := range cm.subscriptions {
+        delete(cm.subscriptions, key)
+        cm.stats.Dropped += uint64(sub.pending())
+        sub.close()
+    }
+    return err
 }
 
-func (dm *DatabaseManager) handleConfigUpdates() {
-    for newConfig := range dm.configChan {
-        if newConfig.Database != dm.config.Database {
-            log.Println("Database config changed, reconnecting...")
-            dm.config = newConfig
-            // Reconnect to database with new config
+// Explain reports which source set each value under path, e.g. "database"
+// or "database.port"; an empty path explains the whole config
+func (cm *ConfigManager) Explain(path string) []ConfigOrigin {
+    var result []ConfigOrigin
+    for p, origin := range cm.manager.Get().Origins {
+        if path == "" || p == path || strings.HasPrefix(p, path+".") {
+            result = append(result, origin)
         }
     }
+    sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+    return result
 }
\ No newline at end of file
@@ -0,0 +1,222 @@
+package main
+
+import (
+    "context"
+    "hash/fnv"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// FlagDefinition is one feature flag in the config file:
+//
+//    flags:
+//      new_checkout:
+//        enabled: true
+//        users: [alice, bob]   # always on for these users
+//        attributes:           # everyone else must match every attribute
+//          country: [US, CA]
+//        percentage: 25        # and then falls in the first 25% of buckets
+//
+// Rules apply in that order. With attributes, a percentage of 0 or unset
+// means every matching user; without them, the percentage alone decides
+// and 0 means nobody. A user gets the same bucket for a flag on every
+// instance, so raising the percentage only ever adds users.
+type FlagDefinition struct {
+    Enabled     bool                `json:"enabled"`
+    Description string              `json:"description"`
+    Users       []string            `json:"users"`
+    Attributes  map[string][]string `json:"attributes"`
+    Percentage  float64             `json:"percentage" validate:"min=0,max=100"`
+}
+
+// FlagContext is who a flag is evaluated for
+type FlagContext struct {
+    UserID     string
+    Attributes map[string]string
+}
+
+type flagContextKey struct{}
+
+// WithFlagContext attaches the user that flags are evaluated for
+func WithFlagContext(ctx context.Context, fc FlagContext) context.Context {
+    return context.WithValue(ctx, flagContextKey{}, fc)
+}
+
+func flagContextFrom(ctx context.Context) FlagContext {
+    fc, _ := ctx.Value(flagContextKey{}).(FlagContext)
+    return fc
+}
+
+// FlagResult says whether a flag is on and which rule decided it
+type FlagResult struct {
+    Enabled bool   `json:"enabled"`
+    Reason  string `json:"reason"` // unknown, disabled, user, attributes, percentage
+}
+
+// FlagStats counts evaluations of one flag since start. A defined flag
+// that nobody evaluates is a candidate for removal.
+type FlagStats struct {
+    Name          string    `json:"name"`
+    Defined       bool      `json:"defined"`
+    True          uint64    `json:"true"`
+    False         uint64    `json:"false"`
+    LastEvaluated time.Time `json:"last_evaluated,omitempty"`
+    Stale         bool      `json:"stale"`
+}
+
+type flagCounter struct {
+    enabled  atomic.Uint64
+    disabled atomic.Uint64
+    last     atomic.Int64
+}
+
+// FeatureFlags evaluates the flags section of the config and follows it
+// as the config changes
+type FeatureFlags struct {
+    flags    atomic.Value // map[string]FlagDefinition
+    counters sync.Map     // flag name -> *flagCounter
+}
+
+// NewFeatureFlags follows flag changes until ctx is done
+func NewFeatureFlags(ctx context.Context, cm *ConfigManager) *FeatureFlags {
+    ff := &FeatureFlags{}
+    current, updates := cm.SubscribeChangesFrom(ctx, "flags")
+    ff.flags.Store(current.Flags)
+    
+    go func() {
+        for update := range updates {
+            ff.flags.Store(update.Config.Flags)
+        }
+    }()
+    
+    return ff
+}
+
+// Enabled reports whether name is on for the user in ctx
+func (ff *FeatureFlags) Enabled(ctx context.Context, name string) bool {
+    return ff.Evaluate(ctx, name).Enabled
+}
+
+// Evaluate decides name for the user in ctx and counts the evaluation.
+// Unknown flags are off.
+func (ff *FeatureFlags) Evaluate(ctx context.Context, name string) FlagResult {
+    flag, ok := ff.flags.Load().(map[string]FlagDefinition)[name]
+    result := FlagResult{Reason: "unknown"}
+    if ok {
+        result = evaluateFlag(name, flag, flagContextFrom(ctx))
+    }
+    
+    counter := ff.counter(name)
+    if result.Enabled {
+        counter.enabled.Add(1)
+    } else {
+        counter.disabled.Add(1)
+    }
+    counter.last.Store(time.Now().UnixNano())
+    return result
+}
+
+func evaluateFlag(name string, flag FlagDefinition, fc FlagContext) FlagResult {
+    if !flag.Enabled {
+        return FlagResult{Reason: "disabled"}
+    }
+    
+    if fc.UserID != "" {
+        for _, user := range flag.Users {
+            if user == fc.UserID {
+                return FlagResult{Enabled: true, Reason: "user"}
+            }
+        }
+    }
+    
+    for attr, allowed := range flag.Attributes {
+        if !containsString(allowed, fc.Attributes[attr]) {
+            return FlagResult{Reason: "attributes"}
+        }
+    }
+    if len(flag.Attributes) > 0 && flag.Percentage == 0 {
+        return FlagResult{Enabled: true, Reason: "attributes"}
+    }
+    
+    return FlagResult{Enabled: flagBucket(name, fc.UserID) < flag.Percentage, Reason: "percentage"}
+}
+
+// flagBucket places a user in [0, 100) for a flag. Hashing the flag name
+// too keeps the same users from being first in every rollout.
+func flagBucket(name, userID string) float64 {
+    h := fnv.New32a()
+    h.Write([]byte(name))
+    h.Write([]byte{0})
+    h.Write([]byte(userID))
+    return float64(h.Sum32()%10000) / 100
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+func (ff *FeatureFlags) counter(name string) *flagCounter {
+    if c, ok := ff.counters.Load(name); ok {
+        return c.(*flagCounter)
+    }
+    c, _ := ff.counters.LoadOrStore(name, &flagCounter{})
+    return c.(*flagCounter)
+}
+
+// Stats lists every defined or evaluated flag; stale flags are defined
+// but were never evaluated
+func (ff *FeatureFlags) Stats() []FlagStats {
+    flags := ff.flags.Load().(map[string]FlagDefinition)
+    byName := make(map[string]*FlagStats)
+    for name := range flags {
+        byName[name] = &FlagStats{Name: name, Defined: true}
+    }
+    
+    ff.counters.Range(func(key, value interface{}) bool {
+        name := key.(string)
+        stats, ok := byName[name]
+        if !ok {
+            stats = &FlagStats{Name: name}
+            byName[name] = stats
+        }
+        c := value.(*flagCounter)
+        stats.True = c.enabled.Load()
+        stats.False = c.disabled.Load()
+        if last := c.last.Load(); last > 0 {
+            stats.LastEvaluated = time.Unix(0, last)
+        }
+        return true
+    })
+    
+    result := make([]FlagStats, 0, len(byName))
+    for _, stats := range byName {
+        stats.Stale = stats.Defined && stats.True+stats.False == 0
+        result = append(result, *stats)
+    }
+    sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+    return result
+}
+
+// StatsHandler serves Stats as JSON; ?stale=true lists only stale flags
+func (ff *FeatureFlags) StatsHandler(w http.ResponseWriter, r *http.Request) {
+    stats := ff.Stats()
+    if stale, _ := strconv.ParseBool(r.URL.Query().Get("stale")); stale {
+        filtered := stats[:0]
+        for _, s := range stats {
+            if s.Stale {
+                filtered = append(filtered, s)
+            }
+        }
+        stats = filtered
+    }
+    writeConfigJSON(w, stats)
+}
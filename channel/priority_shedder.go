@@ -0,0 +1,146 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync/atomic"
+)
+
+// PriorityTier is one class of traffic. Reserved tokens of a tier can only
+// be spent by that tier or a more important one.
+type PriorityTier struct {
+    Name     string
+    Reserved int
+    
+    admitted atomic.Int64
+    shed     atomic.Int64
+}
+
+// Classifier maps a request to a tier index, ok=false defers to the next one
+type Classifier func(r *http.Request) (tier int, ok bool)
+
+// ClassifyByHeader picks a tier from a header value, e.g. X-Plan: paid
+func ClassifyByHeader(header string, tiers map[string]int) Classifier {
+    return func(r *http.Request) (int, bool) {
+        tier, ok := tiers[r.Header.Get(header)]
+        return tier, ok
+    }
+}
+
+// ClassifyByPathPrefix picks the tier of the longest matching path prefix
+func ClassifyByPathPrefix(prefixes map[string]int) Classifier {
+    return func(r *http.Request) (int, bool) {
+        best, tier := -1, 0
+        for prefix, t := range prefixes {
+            if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > best {
+                best, tier = len(prefix), t
+            }
+        }
+        return tier, best >= 0
+    }
+}
+
+type TierStats struct {
+    Name     string `json:"name"`
+    Reserved int    `json:"reserved"`
+    Admitted int64  `json:"admitted"`
+    Shed     int64  `json:"shed"`
+}
+
+// PriorityShedder shares one RateLimiter between tiers ordered from most to
+// least important. As the bucket drains, a tier is shed once the tokens
+// left are what more important tiers have reserved, so the lowest tiers go
+// first and the top tier keeps the last tokens.
+type PriorityShedder struct {
+    limiter     *RateLimiter
+    tiers       []*PriorityTier
+    classifiers []Classifier
+    defaultTier int
+    
+    Rejection RejectionConfig
+}
+
+// NewPriorityShedder fails if defaultTier is not an index into tiers
+func NewPriorityShedder(limiter *RateLimiter, tiers []*PriorityTier, defaultTier int, classifiers ...Classifier) (*PriorityShedder, error) {
+    if defaultTier < 0 || defaultTier >= len(tiers) {
+        return nil, fmt.Errorf("priority shedder: default tier %d out of range [0, %d)", defaultTier, len(tiers))
+    }
+    
+    return &PriorityShedder{
+        limiter:     limiter,
+        tiers:       tiers,
+        classifiers: classifiers,
+        defaultTier: defaultTier,
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusServiceUnavailable,
+            Body:       "Server overloaded",
+        },
+    }, nil
+}
+
+func (ps *PriorityShedder) Classify(r *http.Request) int {
+    for _, classify := range ps.classifiers {
+        if tier, ok := classify(r); ok && tier >= 0 && tier < len(ps.tiers) {
+            return tier
+        }
+    }
+    return ps.defaultTier
+}
+
+// reservedAbove is the number of tokens held back for tiers before tier
+func (ps *PriorityShedder) reservedAbove(tier int) int {
+    reserved := 0
+    for _, t := range ps.tiers[:tier] {
+        reserved += t.Reserved
+    }
+    return reserved
+}
+
+func (ps *PriorityShedder) Allow(tier int) bool {
+    t := ps.tiers[tier]
+    
+    if !ps.limiter.Allow() {
+        t.shed.Add(1)
+        return false
+    }
+    // Give the token back if it ate into a more important tier's reservation
+    if ps.limiter.Remaining() < ps.reservedAbove(tier) {
+        ps.limiter.Refund()
+        t.shed.Add(1)
+        return false
+    }
+    
+    t.admitted.Add(1)
+    return true
+}
+
+func (ps *PriorityShedder) Stats() []TierStats {
+    stats := make([]TierStats, len(ps.tiers))
+    for i, t := range ps.tiers {
+        stats[i] = TierStats{
+            Name:     t.Name,
+            Reserved: t.Reserved,
+            Admitted: t.admitted.Load(),
+            Shed:     t.shed.Load(),
+        }
+    }
+    return stats
+}
+
+func (ps *PriorityShedder) StatsHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(ps.Stats())
+}
+
+func (ps *PriorityShedder) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !ps.Allow(ps.Classify(r)) {
+            ps.limiter.writeHeaders(w)
+            writeRejection(w, ps.Rejection, ps.limiter.RetryAfter())
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
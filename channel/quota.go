@@ -0,0 +1,349 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+    "time"
+)
+
+type QuotaPeriod int
+
+const (
+    QuotaDaily QuotaPeriod = iota
+    QuotaMonthly
+)
+
+func (p QuotaPeriod) String() string {
+    if p == QuotaMonthly {
+        return "Month"
+    }
+    return "Day"
+}
+
+// windowStart returns the start of the calendar window containing t in loc
+func (p QuotaPeriod) windowStart(t time.Time, loc *time.Location) time.Time {
+    t = t.In(loc)
+    if p == QuotaMonthly {
+        return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+    }
+    return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+func (p QuotaPeriod) windowEnd(start time.Time) time.Time {
+    if p == QuotaMonthly {
+        return start.AddDate(0, 1, 0)
+    }
+    return start.AddDate(0, 0, 1)
+}
+
+// QuotaPlan is the allowance for one key, 0 means unlimited
+type QuotaPlan struct {
+    Daily   int64
+    Monthly int64
+}
+
+func (p QuotaPlan) limit(period QuotaPeriod) int64 {
+    if period == QuotaMonthly {
+        return p.Monthly
+    }
+    return p.Daily
+}
+
+// quotaWindow is the persisted usage of one key in one window
+type quotaWindow struct {
+    Start time.Time `json:"start"`
+    Used  int64     `json:"used"`
+}
+
+type quotaUsage struct {
+    Windows [2]quotaWindow `json:"windows"` // indexed by QuotaPeriod
+}
+
+type QuotaStatus struct {
+    Period    QuotaPeriod
+    Limit     int64
+    Remaining int64
+    Reset     time.Time
+}
+
+// FileQuotaStore saves usage as one JSON file, replaced atomically
+type FileQuotaStore struct {
+    path string
+}
+
+func NewFileQuotaStore(path string) *FileQuotaStore {
+    return &FileQuotaStore{path: path}
+}
+
+func (s *FileQuotaStore) Load() (map[string]*quotaUsage, error) {
+    usage := make(map[string]*quotaUsage)
+    
+    data, err := os.ReadFile(s.path)
+    if errors.Is(err, os.ErrNotExist) {
+        return usage, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    
+    if err := json.Unmarshal(data, &usage); err != nil {
+        return nil, err
+    }
+    return usage, nil
+}
+
+func (s *FileQuotaStore) Save(usage map[string]*quotaUsage) error {
+    data, err := json.Marshal(usage)
+    if err != nil {
+        return err
+    }
+    
+    tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), s.path)
+}
+
+type QuotaConfig struct {
+    Location      *time.Location // windows reset at midnight here, UTC if nil
+    StorePath     string
+    FlushInterval time.Duration
+    PlanFunc      func(key string) QuotaPlan // required
+    KeyFunc       func(r *http.Request) string
+}
+
+// QuotaManager counts requests per key over daily and monthly calendar
+// windows and periodically flushes the counters to disk.
+type QuotaManager struct {
+    mu      sync.Mutex
+    flushMu sync.Mutex // keeps snapshots hitting the disk in order
+    cfg     QuotaConfig
+    store   *FileQuotaStore
+    usage   map[string]*quotaUsage
+    dirty   bool
+    quit    chan struct{}
+    done    chan struct{}
+    now     func() time.Time
+    
+    Rejection RejectionConfig
+}
+
+func NewQuotaManager(cfg QuotaConfig) (*QuotaManager, error) {
+    if cfg.PlanFunc == nil {
+        return nil, errors.New("quota: PlanFunc is required")
+    }
+    if cfg.StorePath == "" {
+        return nil, errors.New("quota: StorePath is required")
+    }
+    if cfg.Location == nil {
+        cfg.Location = time.UTC
+    }
+    if cfg.FlushInterval <= 0 {
+        cfg.FlushInterval = 5 * time.Second
+    }
+    if cfg.KeyFunc == nil {
+        cfg.KeyFunc = func(r *http.Request) string {
+            if key := r.Header.Get("X-API-Key"); key != "" {
+                return key
+            }
+            return clientIP(r)
+        }
+    }
+    
+    store := NewFileQuotaStore(cfg.StorePath)
+    usage, err := store.Load()
+    if err != nil {
+        return nil, err
+    }
+    
+    qm := &QuotaManager{
+        cfg:   cfg,
+        store: store,
+        usage: usage,
+        quit:  make(chan struct{}),
+        done:  make(chan struct{}),
+        now:   time.Now,
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusTooManyRequests,
+            Body:       "Quota exceeded",
+        },
+    }
+    
+    go qm.flushLoop()
+    
+    return qm, nil
+}
+
+// Consume records one request for key if every window has room left. The
+// returned statuses cover the limited windows, the first one is exhausted
+// when the request was rejected.
+func (qm *QuotaManager) Consume(key string) (bool, []QuotaStatus) {
+    plan := qm.cfg.PlanFunc(key)
+    if plan.Daily <= 0 && plan.Monthly <= 0 {
+        // Unlimited keys are not tracked, so they cost no memory or disk
+        return true, nil
+    }
+    now := qm.now()
+    
+    qm.mu.Lock()
+    defer qm.mu.Unlock()
+    
+    u, ok := qm.usage[key]
+    if !ok {
+        u = &quotaUsage{}
+        qm.usage[key] = u
+    }
+    
+    var statuses []QuotaStatus
+    allowed := true
+    for _, period := range []QuotaPeriod{QuotaDaily, QuotaMonthly} {
+        limit := plan.limit(period)
+        if limit <= 0 {
+            continue
+        }
+        
+        w := &u.Windows[period]
+        start := period.windowStart(now, qm.cfg.Location)
+        if !w.Start.Equal(start) {
+            *w = quotaWindow{Start: start}
+        }
+        
+        status := QuotaStatus{
+            Period:    period,
+            Limit:     limit,
+            Remaining: limit - w.Used,
+            Reset:     period.windowEnd(start),
+        }
+        if status.Remaining <= 0 {
+            allowed = false
+            statuses = append([]QuotaStatus{status}, statuses...)
+            continue
+        }
+        statuses = append(statuses, status)
+    }
+    
+    if !allowed {
+        return false, statuses
+    }
+    
+    for i, status := range statuses {
+        u.Windows[status.Period].Used++
+        statuses[i].Remaining--
+    }
+    qm.dirty = len(statuses) > 0 || qm.dirty
+    return true, statuses
+}
+
+func (qm *QuotaManager) flushLoop() {
+    defer close(qm.done)
+    
+    ticker := time.NewTicker(qm.cfg.FlushInterval)
+    defer ticker.Stop()
+    
+    for {
+        select {
+        case <-ticker.C:
+            if err := qm.Flush(); err != nil {
+                log.Printf("Error saving quota usage: %v", err)
+            }
+        case <-qm.quit:
+            return
+        }
+    }
+}
+
+// Flush writes the counters to disk if they changed since the last flush
+func (qm *QuotaManager) Flush() error {
+    qm.flushMu.Lock()
+    defer qm.flushMu.Unlock()
+    
+    qm.mu.Lock()
+    if qm.pruneLocked(qm.now()) > 0 {
+        qm.dirty = true
+    }
+    if !qm.dirty {
+        qm.mu.Unlock()
+        return nil
+    }
+    snapshot := make(map[string]*quotaUsage, len(qm.usage))
+    for key, u := range qm.usage {
+        copied := *u
+        snapshot[key] = &copied
+    }
+    qm.dirty = false
+    qm.mu.Unlock()
+    
+    if err := qm.store.Save(snapshot); err != nil {
+        qm.mu.Lock()
+        qm.dirty = true
+        qm.mu.Unlock()
+        return err
+    }
+    return nil
+}
+
+// pruneLocked drops keys whose windows have all rolled over, since they
+// would start from zero anyway; the caller holds qm.mu
+func (qm *QuotaManager) pruneLocked(now time.Time) int {
+    pruned := 0
+    for key, u := range qm.usage {
+        current := false
+        for _, period := range []QuotaPeriod{QuotaDaily, QuotaMonthly} {
+            if !u.Windows[period].Start.Before(period.windowStart(now, qm.cfg.Location)) {
+                current = true
+            }
+        }
+        if !current {
+            delete(qm.usage, key)
+            pruned++
+        }
+    }
+    return pruned
+}
+
+// Close stops the flusher and saves the final counters
+func (qm *QuotaManager) Close() error {
+    close(qm.quit)
+    <-qm.done
+    return qm.Flush()
+}
+
+func (qm *QuotaManager) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        allowed, statuses := qm.Consume(qm.cfg.KeyFunc(r))
+        
+        now := qm.now()
+        for _, s := range statuses {
+            h := w.Header()
+            h.Set("X-Quota-Limit-"+s.Period.String(), strconv.FormatInt(s.Limit, 10))
+            h.Set("X-Quota-Remaining-"+s.Period.String(), strconv.FormatInt(max(s.Remaining, 0), 10))
+            h.Set("X-Quota-Reset-"+s.Period.String(), strconv.Itoa(ceilSeconds(s.Reset.Sub(now))))
+        }
+        
+        if !allowed {
+            writeRejection(w, qm.Rejection, statuses[0].Reset.Sub(now))
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "path"
+    "sync"
+    "time"
+)
+
+// Example rules file:
+//
+//    {
+//      "global":  {"capacity": 1000, "refill": "1ms"},
+//      "tenants": {
+//        "*":    {"capacity": 50,  "refill": "20ms"},
+//        "acme": {"capacity": 200, "refill": "5ms"}
+//      },
+//      "routes": [
+//        {"pattern": "/api/reports/*", "capacity": 5, "refill": "1s", "per_tenant": true}
+//      ]
+//    }
+type LimitRules struct {
+    Global  *LimitSpec           `json:"global"`
+    Tenants map[string]LimitSpec `json:"tenants"` // "*" is one plan shared by unlisted tenants
+    Routes  []RouteRule          `json:"routes"`  // first matching pattern wins
+}
+
+type LimitSpec struct {
+    Capacity int          `json:"capacity"`
+    Refill   ruleDuration `json:"refill"`
+}
+
+type RouteRule struct {
+    Pattern   string `json:"pattern"` // path.Match syntax
+    PerTenant bool   `json:"per_tenant"`
+    LimitSpec
+}
+
+// ruleDuration reads durations like "250ms" from JSON
+type ruleDuration time.Duration
+
+func (d *ruleDuration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return err
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = ruleDuration(parsed)
+    return nil
+}
+
+func LoadLimitRules(rulesPath string) (*LimitRules, error) {
+    data, err := os.ReadFile(rulesPath)
+    if err != nil {
+        return nil, err
+    }
+    
+    var rules LimitRules
+    if err := json.Unmarshal(data, &rules); err != nil {
+        return nil, fmt.Errorf("parsing %s: %w", rulesPath, err)
+    }
+    
+    if rules.Global != nil {
+        if err := rules.Global.validate(); err != nil {
+            return nil, fmt.Errorf("global: %w", err)
+        }
+    }
+    for tenant, spec := range rules.Tenants {
+        if err := spec.validate(); err != nil {
+            return nil, fmt.Errorf("tenant %q: %w", tenant, err)
+        }
+    }
+    for _, route := range rules.Routes {
+        if _, err := path.Match(route.Pattern, "/"); err != nil {
+            return nil, fmt.Errorf("route pattern %q: %w", route.Pattern, err)
+        }
+        if err := route.LimitSpec.validate(); err != nil {
+            return nil, fmt.Errorf("route %q: %w", route.Pattern, err)
+        }
+    }
+    return &rules, nil
+}
+
+// validate rejects specs that would never admit a request or would make
+// NewRateLimiter's ticker panic
+func (spec LimitSpec) validate() error {
+    if spec.Capacity <= 0 {
+        return fmt.Errorf("capacity must be positive, got %d", spec.Capacity)
+    }
+    if spec.Refill <= 0 {
+        return fmt.Errorf("refill must be positive, got %v", time.Duration(spec.Refill))
+    }
+    return nil
+}
+
+// HierarchicalLimiter makes a request pass global, tenant and route limits
+// in that order. A token taken by an earlier limit is refunded when a
+// later one rejects, so a rejected request costs nothing.
+type HierarchicalLimiter struct {
+    mu       sync.Mutex
+    rules    *LimitRules
+    global   *RateLimiter
+    limiters map[string]*RateLimiter
+    
+    // TenantFunc identifies the tenant, defaults to the X-Tenant-ID header
+    TenantFunc func(r *http.Request) string
+    Rejection  RejectionConfig
+}
+
+type namedLimiter struct {
+    name    string
+    limiter *RateLimiter
+}
+
+func NewHierarchicalLimiter(rules *LimitRules) *HierarchicalLimiter {
+    hl := &HierarchicalLimiter{
+        rules:    rules,
+        limiters: make(map[string]*RateLimiter),
+        TenantFunc: func(r *http.Request) string {
+            return r.Header.Get("X-Tenant-ID")
+        },
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusTooManyRequests,
+            Body:       "Rate limit exceeded",
+        },
+    }
+    
+    if rules.Global != nil {
+        hl.global = newLimiterFromSpec(*rules.Global)
+    }
+    
+    return hl
+}
+
+func newLimiterFromSpec(spec LimitSpec) *RateLimiter {
+    return NewRateLimiter(spec.Capacity, time.Duration(spec.Refill))
+}
+
+// limitersFor returns the ordered limits that apply to a request
+func (hl *HierarchicalLimiter) limitersFor(tenant, routePath string) []namedLimiter {
+    hl.mu.Lock()
+    defer hl.mu.Unlock()
+    
+    var chain []namedLimiter
+    if hl.global != nil {
+        chain = append(chain, namedLimiter{"global", hl.global})
+    }
+    
+    // Tenants without their own plan share one "*" bucket; a limiter per
+    // unknown X-Tenant-ID would let clients create tickers without bound
+    spec, ok := hl.rules.Tenants[tenant]
+    if !ok {
+        tenant = "*"
+        spec, ok = hl.rules.Tenants["*"]
+    }
+    if ok {
+        chain = append(chain, hl.limiterLocked("tenant:"+tenant, spec))
+    }
+    
+    for _, route := range hl.rules.Routes {
+        if matched, _ := path.Match(route.Pattern, routePath); !matched {
+            continue
+        }
+        name := "route:" + route.Pattern
+        if route.PerTenant {
+            name += "|tenant:" + tenant
+        }
+        chain = append(chain, hl.limiterLocked(name, route.LimitSpec))
+        break
+    }
+    
+    return chain
+}
+
+func (hl *HierarchicalLimiter) limiterLocked(name string, spec LimitSpec) namedLimiter {
+    limiter, ok := hl.limiters[name]
+    if !ok {
+        limiter = newLimiterFromSpec(spec)
+        hl.limiters[name] = limiter
+    }
+    return namedLimiter{name, limiter}
+}
+
+// Allow takes a token from every applicable limit. On rejection it returns
+// the limit that said no after refunding the ones that had said yes.
+func (hl *HierarchicalLimiter) Allow(tenant, routePath string) (bool, *RateLimiter) {
+    allowed, rejectedBy, _ := hl.allow(tenant, routePath)
+    return allowed, rejectedBy
+}
+
+func (hl *HierarchicalLimiter) allow(tenant, routePath string) (bool, *RateLimiter, []namedLimiter) {
+    chain := hl.limitersFor(tenant, routePath)
+    
+    for i, layer := range chain {
+        if layer.limiter.Allow() {
+            continue
+        }
+        for _, taken := range chain[:i] {
+            taken.limiter.Refund()
+        }
+        return false, layer.limiter, chain
+    }
+    return true, nil, chain
+}
+
+func (hl *HierarchicalLimiter) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        allowed, rejectedBy, chain := hl.allow(hl.TenantFunc(r), r.URL.Path)
+        
+        if !allowed {
+            rejectedBy.writeHeaders(w)
+            writeRejection(w, hl.Rejection, rejectedBy.RetryAfter())
+            return
+        }
+        
+        // Report the tightest limit so clients back off before hitting it
+        if tightest := tightestLimiter(chain); tightest != nil {
+            tightest.writeHeaders(w)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func tightestLimiter(chain []namedLimiter) *RateLimiter {
+    var tightest *RateLimiter
+    for _, layer := range chain {
+        if tightest == nil || layer.limiter.Remaining() < tightest.Remaining() {
+            tightest = layer.limiter
+        }
+    }
+    return tightest
+}
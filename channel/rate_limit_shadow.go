@@ -0,0 +1,148 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// ShadowLimiter runs a limiter in dry-run mode: it records and logs the
+// requests that would have been rejected but lets every request through.
+type ShadowLimiter struct {
+    mu       sync.Mutex
+    evaluate func(r *http.Request) bool
+    hits     map[shadowKey]*ShadowOffender
+    total    int64
+    rejected int64
+    
+    KeyFunc    func(r *http.Request) string
+    LogEvery   int64 // log the 1st, then every Nth would-be rejection per key and route
+    MaxTracked int   // key and route pairs kept; the least rejected half goes when full
+}
+
+type shadowKey struct {
+    key   string
+    route string
+}
+
+type ShadowOffender struct {
+    Key       string    `json:"key"`
+    Route     string    `json:"route"`
+    Rejected  int64     `json:"would_reject"`
+    FirstSeen time.Time `json:"first_seen"`
+    LastSeen  time.Time `json:"last_seen"`
+}
+
+type ShadowReport struct {
+    Total        int64            `json:"total"`
+    WouldReject  int64            `json:"would_reject"`
+    TopOffenders []ShadowOffender `json:"top_offenders"`
+}
+
+// NewShadowLimiter shadows rl. rl should be a dedicated instance since
+// shadow evaluation consumes its tokens.
+func NewShadowLimiter(rl *RateLimiter) *ShadowLimiter {
+    return &ShadowLimiter{
+        evaluate:   func(r *http.Request) bool { return rl.Allow() },
+        hits:       make(map[shadowKey]*ShadowOffender),
+        KeyFunc:    clientIP,
+        LogEvery:   100,
+        MaxTracked: 10000,
+    }
+}
+
+func (sl *ShadowLimiter) record(r *http.Request) {
+    allowed := sl.evaluate(r)
+    
+    sl.mu.Lock()
+    defer sl.mu.Unlock()
+    
+    sl.total++
+    if allowed {
+        return
+    }
+    sl.rejected++
+    
+    k := shadowKey{key: sl.KeyFunc(r), route: r.URL.Path}
+    now := time.Now()
+    offender, ok := sl.hits[k]
+    if !ok {
+        // Keys and paths come from clients, so the map must not grow unbounded
+        if sl.MaxTracked > 0 && len(sl.hits) >= sl.MaxTracked {
+            sl.evictLocked()
+        }
+        offender = &ShadowOffender{Key: k.key, Route: k.route, FirstSeen: now}
+        sl.hits[k] = offender
+    }
+    offender.Rejected++
+    offender.LastSeen = now
+    
+    if offender.Rejected == 1 || (sl.LogEvery > 0 && offender.Rejected%sl.LogEvery == 0) {
+        log.Printf("Shadow rate limit would reject %s %s (%d times)", k.key, k.route, offender.Rejected)
+    }
+}
+
+// evictLocked drops the least rejected half of the tracked pairs. Halving
+// keeps eviction rare instead of sorting on every new pair.
+func (sl *ShadowLimiter) evictLocked() {
+    keys := make([]shadowKey, 0, len(sl.hits))
+    for k := range sl.hits {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return sl.hits[keys[i]].Rejected < sl.hits[keys[j]].Rejected
+    })
+    for _, k := range keys[:len(keys)/2+1] {
+        delete(sl.hits, k)
+    }
+}
+
+func (sl *ShadowLimiter) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        sl.record(r)
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Report returns the n keys and routes with the most would-be rejections
+func (sl *ShadowLimiter) Report(n int) ShadowReport {
+    sl.mu.Lock()
+    defer sl.mu.Unlock()
+    
+    offenders := make([]ShadowOffender, 0, len(sl.hits))
+    for _, offender := range sl.hits {
+        offenders = append(offenders, *offender)
+    }
+    sort.Slice(offenders, func(i, j int) bool {
+        return offenders[i].Rejected > offenders[j].Rejected
+    })
+    if n > 0 && len(offenders) > n {
+        offenders = offenders[:n]
+    }
+    
+    return ShadowReport{
+        Total:        sl.total,
+        WouldReject:  sl.rejected,
+        TopOffenders: offenders,
+    }
+}
+
+// ReportHandler serves Report as JSON, ?top=N picks how many (default 20)
+func (sl *ShadowLimiter) ReportHandler(w http.ResponseWriter, r *http.Request) {
+    top := 20
+    if s := r.URL.Query().Get("top"); s != "" {
+        n, err := strconv.Atoi(s)
+        if err != nil || n < 1 {
+            http.Error(w, "top must be a positive integer", http.StatusBadRequest)
+            return
+        }
+        top = n
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(sl.Report(top))
+}
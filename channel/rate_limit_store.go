@@ -0,0 +1,182 @@
+package main
+
+import (
+    "context"
+    "log"
+    "net"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Limit is a GCRA limit: Burst requests, one new request every Period
+type Limit struct {
+    Burst  int
+    Period time.Duration
+}
+
+// Window returns the time it takes to earn back a full burst
+func (l Limit) Window() time.Duration {
+    return time.Duration(l.Burst) * l.Period
+}
+
+type LimitResult struct {
+    Allowed    bool
+    Remaining  int
+    RetryAfter time.Duration // zero when allowed
+    ResetAfter time.Duration // until the full burst is available again
+}
+
+// LimitStore performs an atomic GCRA check-and-update for a key.
+// Every replica pointing at the same store shares the same limit.
+type LimitStore interface {
+    Take(ctx context.Context, key string, limit Limit) (LimitResult, error)
+}
+
+// gcra applies one request to a theoretical arrival time (TAT) and returns
+// the new TAT along with the result. All times are in the same unit.
+func gcra(tat, now, period, burst int64) (int64, LimitResult) {
+    if tat < now {
+        tat = now
+    }
+    
+    tolerance := period * burst
+    newTat := tat + period
+    if newTat-now > tolerance {
+        return tat, LimitResult{
+            RetryAfter: time.Duration(newTat - now - tolerance),
+            ResetAfter: time.Duration(tat - now),
+        }
+    }
+    
+    return newTat, LimitResult{
+        Allowed:    true,
+        Remaining:  int((tolerance - (newTat - now)) / period),
+        ResetAfter: time.Duration(newTat - now),
+    }
+}
+
+// MemoryStore keeps TATs in process. Useful for a single instance and tests.
+type MemoryStore struct {
+    mu   sync.Mutex
+    tats map[string]int64
+    now  func() time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        tats: make(map[string]int64),
+        now:  time.Now,
+    }
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+    if err := ctx.Err(); err != nil {
+        return LimitResult{}, err
+    }
+    
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    
+    now := s.now().UnixNano()
+    tat, result := gcra(s.tats[key], now, int64(limit.Period), int64(limit.Burst))
+    if tat <= now {
+        delete(s.tats, key)
+    } else {
+        s.tats[key] = tat
+    }
+    return result, nil
+}
+
+// FailurePolicy decides what StoreLimiter does when the store is unreachable
+type FailurePolicy int
+
+const (
+    FailLocal  FailurePolicy = iota // use the local RateLimiter
+    FailOpen                        // allow every request
+    FailClosed                      // reject every request
+)
+
+type StoreLimiter struct {
+    store   LimitStore
+    limit   Limit
+    local   *RateLimiter
+    policy  FailurePolicy
+    timeout time.Duration
+    down    atomic.Bool // logged once per outage, not per request
+    
+    // KeyFunc picks the bucket for a request, defaults to the client IP
+    KeyFunc   func(r *http.Request) string
+    Rejection RejectionConfig
+}
+
+// NewStoreLimiter limits requests against a shared store. local may be nil,
+// in which case FailLocal behaves like FailOpen.
+func NewStoreLimiter(store LimitStore, limit Limit, local *RateLimiter, policy FailurePolicy) *StoreLimiter {
+    return &StoreLimiter{
+        store:   store,
+        limit:   limit,
+        local:   local,
+        policy:  policy,
+        timeout: 50 * time.Millisecond,
+        KeyFunc: clientIP,
+        Rejection: RejectionConfig{
+            StatusCode: http.StatusTooManyRequests,
+            Body:       "Rate limit exceeded",
+        },
+    }
+}
+
+func (sl *StoreLimiter) Take(ctx context.Context, key string) LimitResult {
+    ctx, cancel := context.WithTimeout(ctx, sl.timeout)
+    defer cancel()
+    
+    result, err := sl.store.Take(ctx, key, sl.limit)
+    if err == nil {
+        if sl.down.CompareAndSwap(true, false) {
+            log.Printf("Rate limit store available again")
+        }
+        return result
+    }
+    
+    if sl.down.CompareAndSwap(false, true) {
+        log.Printf("Rate limit store unavailable, falling back: %v", err)
+    }
+    return sl.fallback()
+}
+
+func (sl *StoreLimiter) fallback() LimitResult {
+    switch {
+    case sl.policy == FailClosed:
+        return LimitResult{RetryAfter: sl.limit.Period}
+    case sl.policy == FailLocal && sl.local != nil:
+        if !sl.local.Allow() {
+            return LimitResult{RetryAfter: sl.local.RetryAfter(), ResetAfter: sl.local.ResetAfter()}
+        }
+        return LimitResult{Allowed: true, Remaining: sl.local.Remaining(), ResetAfter: sl.local.ResetAfter()}
+    default:
+        return LimitResult{Allowed: true}
+    }
+}
+
+func (sl *StoreLimiter) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        result := sl.Take(r.Context(), sl.KeyFunc(r))
+        setRateLimitHeaders(w, sl.limit.Burst, result.Remaining, result.ResetAfter, sl.limit.Window())
+        
+        if !result.Allowed {
+            writeRejection(w, sl.Rejection, result.RetryAfter)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// RESPError is an error reply sent by the server, e.g. "NOSCRIPT ..."
+type RESPError string
+
+func (e RESPError) Error() string {
+    return string(e)
+}
+
+// RESPClient is a minimal Redis protocol client with one lazily dialed
+// connection. Commands are serialized; on any I/O error the connection
+// is dropped and redialed on the next call. A dial is bounded by
+// dialTimeout rather than the caller's context, so when a caller with a
+// tight deadline gives up, the next call finds the connection ready.
+type RESPClient struct {
+    // sem is a one-slot lock that callers can stop waiting for when their
+    // context ends, so a slow server can't queue them past their deadline
+    sem         chan struct{}
+    addr        string
+    dialTimeout time.Duration
+    dialing     *pendingDial
+    conn        net.Conn
+    reader      *bufio.Reader
+}
+
+type pendingDial struct {
+    done chan struct{}
+    conn net.Conn
+    err  error
+}
+
+func NewRESPClient(addr string) *RESPClient {
+    return &RESPClient{
+        sem:         make(chan struct{}, 1),
+        addr:        addr,
+        dialTimeout: time.Second,
+    }
+}
+
+func (c *RESPClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+    select {
+    case c.sem <- struct{}{}:
+    case <-ctx.Done():
+        return nil, ctx.Err()
+    }
+    defer func() { <-c.sem }()
+    
+    if c.conn == nil {
+        if err := c.connectLocked(ctx); err != nil {
+            return nil, err
+        }
+    }
+    
+    if deadline, ok := ctx.Deadline(); ok {
+        c.conn.SetDeadline(deadline)
+    } else {
+        c.conn.SetDeadline(time.Time{})
+    }
+    
+    reply, err := c.roundTrip(args)
+    if err != nil {
+        var respErr RESPError
+        if !errors.As(err, &respErr) {
+            c.conn.Close()
+            c.conn = nil
+        }
+        return nil, err
+    }
+    return reply, nil
+}
+
+// connectLocked waits for a dial, starting one if none is in flight; the
+// caller holds sem. A dial the caller stops waiting for keeps going for the
+// next call to pick up.
+func (c *RESPClient) connectLocked(ctx context.Context) error {
+    if c.dialing == nil {
+        d := &pendingDial{done: make(chan struct{})}
+        c.dialing = d
+        go func() {
+            dialer := net.Dialer{Timeout: c.dialTimeout}
+            d.conn, d.err = dialer.Dial("tcp", c.addr)
+            close(d.done)
+        }()
+    }
+    
+    select {
+    case <-c.dialing.done:
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+    
+    d := c.dialing
+    c.dialing = nil
+    if d.err != nil {
+        return d.err
+    }
+    c.conn = d.conn
+    c.reader = bufio.NewReader(d.conn)
+    return nil
+}
+
+func (c *RESPClient) roundTrip(args []string) (interface{}, error) {
+    var b strings.Builder
+    fmt.Fprintf(&b, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+    }
+    if _, err := io.WriteString(c.conn, b.String()); err != nil {
+        return nil, err
+    }
+    return readReply(c.reader)
+}
+
+func (c *RESPClient) Close() error {
+    c.sem <- struct{}{}
+    defer func() { <-c.sem }()
+    
+    if d := c.dialing; d != nil {
+        c.dialing = nil
+        go func() {
+            <-d.done
+            if d.conn != nil {
+                d.conn.Close()
+            }
+        }()
+    }
+    if c.conn == nil {
+        return nil
+    }
+    err := c.conn.Close()
+    c.conn = nil
+    return err
+}
+
+// readReply decodes a single RESP2 value
+func readReply(r *bufio.Reader) (interface{}, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+        return nil, fmt.Errorf("malformed reply %q", line)
+    }
+    kind, payload := line[0], line[1:len(line)-2]
+    
+    switch kind {
+    case '+':
+        return payload, nil
+    case '-':
+        return nil, RESPError(payload)
+    case ':':
+        return strconv.ParseInt(payload, 10, 64)
+    case '$':
+        n, err := strconv.Atoi(payload)
+        if err != nil || n < 0 {
+            return nil, err // nil bulk string
+        }
+        buf := make([]byte, n+2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        return string(buf[:n]), nil
+    case '*':
+        n, err := strconv.Atoi(payload)
+        if err != nil || n < 0 {
+            return nil, err // nil array
+        }
+        items := make([]interface{}, n)
+        for i := range items {
+            if items[i], err = readReply(r); err != nil {
+                var respErr RESPError
+                if !errors.As(err, &respErr) {
+                    return nil, err
+                }
+                items[i] = respErr
+            }
+        }
+        return items, nil
+    default:
+        return nil, fmt.Errorf("unknown reply type %q", kind)
+    }
+}
+
+// gcraScript is the GCRA from gcra() run atomically inside Redis. It uses the
+// server clock so replicas with skewed clocks still agree. Times are in
+// microseconds.
+const gcraScript = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local period = tonumber(ARGV[1])
+local tolerance = period * tonumber(ARGV[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local newtat = tat + period
+if newtat - now > tolerance then
+  return {0, 0, newtat - now - tolerance, tat - now}
+end
+redis.call('SET', KEYS[1], newtat, 'PX', math.ceil((newtat - now) / 1000))
+return {1, math.floor((tolerance - (newtat - now)) / period), 0, newtat - now}
+`
+
+// RedisStore runs GCRA against any server speaking RESP (Redis, Valkey, KeyDB)
+type RedisStore struct {
+    client *RESPClient
+    prefix string
+    sha    atomic.Value // string, set after SCRIPT LOAD
+}
+
+func NewRedisStore(client *RESPClient, prefix string) *RedisStore {
+    return &RedisStore{client: client, prefix: prefix}
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit) (LimitResult, error) {
+    args := []string{
+        s.prefix + key,
+        strconv.FormatInt(limit.Period.Microseconds(), 10),
+        strconv.Itoa(limit.Burst),
+    }
+    
+    reply, err := s.eval(ctx, args)
+    if err != nil {
+        return LimitResult{}, err
+    }
+    
+    values, ok := reply.([]interface{})
+    if !ok || len(values) != 4 {
+        return LimitResult{}, fmt.Errorf("unexpected script reply %v", reply)
+    }
+    nums := make([]int64, len(values))
+    for i, v := range values {
+        if nums[i], ok = v.(int64); !ok {
+            return LimitResult{}, fmt.Errorf("unexpected script reply %v", reply)
+        }
+    }
+    
+    return LimitResult{
+        Allowed:    nums[0] == 1,
+        Remaining:  int(nums[1]),
+        RetryAfter: time.Duration(nums[2]) * time.Microsecond,
+        ResetAfter: time.Duration(nums[3]) * time.Microsecond,
+    }, nil
+}
+
+// eval prefers EVALSHA and loads the script on NOSCRIPT
+func (s *RedisStore) eval(ctx context.Context, args []string) (interface{}, error) {
+    if sha, _ := s.sha.Load().(string); sha != "" {
+        reply, err := s.client.Do(ctx, append([]string{"EVALSHA", sha, "1"}, args...)...)
+        var respErr RESPError
+        if err == nil || !errors.As(err, &respErr) || !strings.HasPrefix(string(respErr), "NOSCRIPT") {
+            return reply, err
+        }
+    }
+    
+    reply, err := s.client.Do(ctx, "SCRIPT", "LOAD", gcraScript)
+    if err != nil {
+        return nil, err
+    }
+    sha, _ := reply.(string)
+    s.sha.Store(sha)
+    
+    return s.client.Do(ctx, append([]string{"EVALSHA", sha, "1"}, args...)...)
+}
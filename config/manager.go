@@ -0,0 +1,263 @@
+// Package config keeps the current value of a configuration of any type
+// and reloads it when a watcher reports a change. Readers get immutable
+// snapshots through an atomic pointer, so Get never blocks, not even
+// during a reload.
+package config
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrClosed = errors.New("config: manager closed")
+
+// Snapshot is one published version. It must not be modified; a reload
+// publishes a new Snapshot instead.
+type Snapshot[T any] struct {
+	Value    *T
+	Version  uint64
+	LoadedAt time.Time
+}
+
+type Options[T any] struct {
+	// Load reads the configuration, e.g. JSONFile(path)
+	Load func() (*T, error)
+	// Validate rejects a loaded value; the previous snapshot stays current
+	Validate func(*T) error
+	// Watchers trigger reloads, see FileWatcher and IntervalWatcher
+	Watchers []Watcher
+	// OnError receives failed reloads triggered by watchers; they are logged if unset
+	OnError func(error)
+}
+
+// Manager publishes snapshots of a T. Create it with New.
+type Manager[T any] struct {
+	opts    Options[T]
+	current atomic.Pointer[Snapshot[T]]
+
+	reloadMu sync.Mutex // one reload at a time, so versions are in order
+
+	mu        sync.Mutex
+	callbacks map[uint64]func(old, new *Snapshot[T])
+	channels  map[uint64]chan *Snapshot[T]
+	nextID    uint64
+	closed    bool
+
+	quit chan struct{}
+	done sync.WaitGroup
+}
+
+// New loads the initial value and starts the watchers. It fails when the
+// initial value cannot be loaded or is invalid; the watchers are closed
+// then too.
+func New[T any](opts Options[T]) (*Manager[T], error) {
+	if opts.Load == nil {
+		return nil, errors.New("config: Options.Load is required")
+	}
+
+	m := &Manager[T]{
+		opts:      opts,
+		callbacks: make(map[uint64]func(old, new *Snapshot[T])),
+		channels:  make(map[uint64]chan *Snapshot[T]),
+		quit:      make(chan struct{}),
+	}
+	if err := m.Reload(); err != nil {
+		for _, w := range opts.Watchers {
+			w.Close()
+		}
+		return nil, err
+	}
+
+	for _, w := range opts.Watchers {
+		m.done.Add(1)
+		go m.watch(w)
+	}
+	return m, nil
+}
+
+// Get returns the current value without locking. Treat it as read-only.
+func (m *Manager[T]) Get() *T {
+	return m.current.Load().Value
+}
+
+// Snapshot returns the current value with its version
+func (m *Manager[T]) Snapshot() *Snapshot[T] {
+	return m.current.Load()
+}
+
+// Reload loads, validates and publishes a new snapshot. On error the
+// current snapshot is kept.
+func (m *Manager[T]) Reload() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	value, err := m.opts.Load()
+	if err != nil {
+		return err
+	}
+	if m.opts.Validate != nil {
+		if err := m.opts.Validate(value); err != nil {
+			return err
+		}
+	}
+	m.publish(value)
+	return nil
+}
+
+// Set publishes value as if it had been loaded, e.g. for a rollback. It
+// stays current until the next reload.
+func (m *Manager[T]) Set(value *T) error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+
+	if m.opts.Validate != nil {
+		if err := m.opts.Validate(value); err != nil {
+			return err
+		}
+	}
+	m.publish(value)
+	return nil
+}
+
+// publish swaps in a new snapshot and notifies subscribers; the caller
+// holds reloadMu
+func (m *Manager[T]) publish(value *T) {
+	old := m.current.Load()
+	next := &Snapshot[T]{Value: value, Version: 1, LoadedAt: time.Now()}
+	if old != nil {
+		next.Version = old.Version + 1
+	}
+	m.current.Store(next)
+
+	if old == nil {
+		return
+	}
+
+	m.mu.Lock()
+	callbacks := make([]func(old, new *Snapshot[T]), 0, len(m.callbacks))
+	for _, fn := range m.callbacks {
+		callbacks = append(callbacks, fn)
+	}
+	for _, ch := range m.channels {
+		offer(ch, next)
+	}
+	m.mu.Unlock()
+
+	// Outside m.mu, so a callback may subscribe or unsubscribe
+	for _, fn := range callbacks {
+		fn(old, next)
+	}
+}
+
+// offer replaces an unread snapshot with the newer one; the caller holds
+// m.mu, so only the subscriber can receive concurrently
+func offer[T any](ch chan *Snapshot[T], s *Snapshot[T]) {
+	for {
+		select {
+		case ch <- s:
+			return
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+	}
+}
+
+// OnChange calls fn after every new snapshot, on the goroutine that
+// reloaded, so fn must not call Reload or Set. Call the returned func to
+// stop.
+func (m *Manager[T]) OnChange(fn func(old, new *Snapshot[T])) (cancel func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextID++
+	id := m.nextID
+	m.callbacks[id] = fn
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.callbacks, id)
+	}
+}
+
+// Subscribe receives the current snapshot and every newer one. A slow
+// reader skips to the latest. The channel closes when ctx is done or the
+// manager is closed.
+func (m *Manager[T]) Subscribe(ctx context.Context) <-chan *Snapshot[T] {
+	ch := make(chan *Snapshot[T], 1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		close(ch)
+		return ch
+	}
+	ch <- m.current.Load()
+	m.nextID++
+	id := m.nextID
+	m.channels[id] = ch
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-m.quit:
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := m.channels[id]; ok {
+			delete(m.channels, id)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+func (m *Manager[T]) watch(w Watcher) {
+	defer m.done.Done()
+	defer w.Close()
+
+	for {
+		select {
+		case <-m.quit:
+			return
+		case _, ok := <-w.Changes():
+			if !ok {
+				return
+			}
+			if err := m.Reload(); err != nil {
+				if m.opts.OnError != nil {
+					m.opts.OnError(err)
+				} else {
+					log.Printf("config: reload failed, keeping version %d: %v", m.Snapshot().Version, err)
+				}
+			}
+		}
+	}
+}
+
+// Close stops the watchers and closes subscription channels. Get keeps
+// returning the last snapshot.
+func (m *Manager[T]) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	close(m.quit)
+	for id, ch := range m.channels {
+		delete(m.channels, id)
+		close(ch)
+	}
+	m.mu.Unlock()
+
+	m.done.Wait()
+	return nil
+}
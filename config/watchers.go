@@ -0,0 +1,102 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/harshithgowdakt/learn-go/filewatch"
+)
+
+// Watcher reports that the configuration may have changed. The Manager
+// reloads on every value and closes the watcher when it is closed.
+type Watcher interface {
+	Changes() <-chan struct{}
+	Close() error
+}
+
+type fileWatcher struct {
+	w *filewatch.Watcher
+}
+
+// FileWatcher reloads when the content of path changes
+func FileWatcher(path string, opts filewatch.Options) (Watcher, error) {
+	w, err := filewatch.New(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fileWatcher{w: w}, nil
+}
+
+func (f fileWatcher) Changes() <-chan struct{} { return f.w.Events }
+func (f fileWatcher) Close() error             { return f.w.Close() }
+
+type intervalWatcher struct {
+	ticker *time.Ticker
+	ch     chan struct{}
+	quit   chan struct{}
+	once   sync.Once
+}
+
+// IntervalWatcher reloads every d, for sources that cannot be watched
+func IntervalWatcher(d time.Duration) Watcher {
+	w := &intervalWatcher{
+		ticker: time.NewTicker(d),
+		ch:     make(chan struct{}),
+		quit:   make(chan struct{}),
+	}
+	go func() {
+		defer close(w.ch)
+		for {
+			select {
+			case <-w.quit:
+				return
+			case <-w.ticker.C:
+				select {
+				case w.ch <- struct{}{}:
+				case <-w.quit:
+					return
+				}
+			}
+		}
+	}()
+	return w
+}
+
+func (w *intervalWatcher) Changes() <-chan struct{} { return w.ch }
+
+func (w *intervalWatcher) Close() error {
+	w.once.Do(func() {
+		w.ticker.Stop()
+		close(w.quit)
+	})
+	return nil
+}
+
+type chanWatcher struct {
+	ch <-chan struct{}
+}
+
+// ChanWatcher reloads whenever ch receives, e.g. from a signal handler
+func ChanWatcher(ch <-chan struct{}) Watcher {
+	return chanWatcher{ch: ch}
+}
+
+func (w chanWatcher) Changes() <-chan struct{} { return w.ch }
+func (w chanWatcher) Close() error             { return nil }
+
+// JSONFile is a Load func that decodes path into a new T
+func JSONFile[T any](path string) func() (*T, error) {
+	return func() (*T, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value := new(T)
+		if err := json.Unmarshal(data, value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+}
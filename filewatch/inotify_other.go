@@ -0,0 +1,9 @@
+//go:build !linux
+
+package filewatch
+
+import "errors"
+
+func startInotify(path string, notify func()) (func() error, error) {
+	return nil, errors.New("inotify is only available on linux")
+}
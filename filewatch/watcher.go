@@ -0,0 +1,172 @@
+// Package filewatch notifies when the contents of a single file change.
+// It uses inotify where available and falls back to polling the file's
+// modification time, size and hash.
+package filewatch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type Options struct {
+	Debounce     time.Duration // quiet period before a burst of writes is reported, 100ms if unset
+	PollInterval time.Duration // used when inotify is unavailable, 5s if unset
+	ForcePolling bool
+}
+
+// Watcher reports content changes of one file on Events. Several writes in
+// quick succession, or replacing the file via rename, produce one event.
+// Writes that leave the content unchanged produce none. Events is closed
+// by Close.
+type Watcher struct {
+	Events <-chan struct{}
+
+	path    string
+	opts    Options
+	events  chan struct{}
+	raw     chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+	closeFn func() error
+	once    sync.Once
+	lastSum []byte
+}
+
+func New(path string, opts Options) (*Watcher, error) {
+	if opts.Debounce <= 0 {
+		opts.Debounce = 100 * time.Millisecond
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = 5 * time.Second
+	}
+
+	w := &Watcher{
+		path:   path,
+		opts:   opts,
+		events: make(chan struct{}, 1),
+		raw:    make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w.Events = w.events
+	w.lastSum, _ = fileHash(path)
+
+	started := false
+	if !opts.ForcePolling {
+		closeFn, err := startInotify(path, w.notify)
+		if err == nil {
+			w.closeFn = closeFn
+			started = true
+		} else {
+			log.Printf("filewatch: inotify unavailable for %s, polling: %v", path, err)
+		}
+	}
+	if !started {
+		go w.poll()
+	}
+
+	go w.debounce()
+
+	return w, nil
+}
+
+// notify records that something happened to the file, without blocking
+func (w *Watcher) notify() {
+	select {
+	case w.raw <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Watcher) debounce() {
+	defer close(w.done)
+	defer close(w.events)
+
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.raw:
+			timer.Reset(w.opts.Debounce)
+
+		case <-timer.C:
+			sum, err := fileHash(w.path)
+			if err != nil || bytes.Equal(sum, w.lastSum) {
+				// Missing mid-rename or unchanged content
+				continue
+			}
+			w.lastSum = sum
+
+			select {
+			case w.events <- struct{}{}:
+			default:
+				// Previous event not consumed yet, it covers this one
+			}
+
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// poll is the fallback: cheap stat every interval, hashing only on change
+func (w *Watcher) poll() {
+	ticker := time.NewTicker(w.opts.PollInterval)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(w.path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			w.notify()
+
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+func (w *Watcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		close(w.quit)
+		if w.closeFn != nil {
+			err = w.closeFn()
+		}
+		<-w.done
+	})
+	return err
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
-	"sync"
+	"os"
 	"time"
+
+	"github.com/harshithgowdakt/learn-go/config"
+	"github.com/harshithgowdakt/learn-go/filewatch"
 )
 
 type Config struct {
@@ -21,68 +24,78 @@ type Config struct {
 	} `json:"api"`
 }
 
+// loadedConfig keeps the file's modification time in the same snapshot as
+// the config read from it
+type loadedConfig struct {
+	config  Config
+	modTime time.Time
+}
+
+// ConfigManager reads the config through lock-free snapshots; see the
+// config package
 type ConfigManager struct {
-	mu         sync.RWMutex
-	config     Config
 	configPath string
-	lastMod    time.Time
+	manager    *config.Manager[loadedConfig]
 }
 
-func NewConfigManager(configPath string) *ConfigManager {
+func NewConfigManager(configPath string) (*ConfigManager, error) {
 	cm := &ConfigManager{
 		configPath: configPath,
 	}
 
-	cm.loadConfig()
-
 	// Start background config watcher
-	go cm.watchConfig()
+	watcher, err := config.FileWatcher(configPath, filewatch.Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	cm.manager, err = config.New(config.Options[loadedConfig]{
+		Load:     cm.loadConfig,
+		Watchers: []config.Watcher{watcher},
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	cm.manager.OnChange(func(old, new *config.Snapshot[loadedConfig]) {
+		log.Println("Configuration reloaded")
+	})
 
-	return cm
+	return cm, nil
 }
 
-func (cm *ConfigManager) loadConfig() {
-	data, err := ioutil.ReadFile(cm.configPath)
+func (cm *ConfigManager) loadConfig() (*loadedConfig, error) {
+	info, err := os.Stat(cm.configPath)
 	if err != nil {
-		log.Printf("Error reading config: %v", err)
-		return
+		return nil, err
 	}
 
-	var newConfig Config
-	if err := json.Unmarshal(data, &newConfig); err != nil {
-		log.Printf("Error parsing config: %v", err)
-		return
+	data, err := ioutil.ReadFile(cm.configPath)
+	if err != nil {
+		return nil, err
 	}
 
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
-
-	cm.config = newConfig
-	log.Println("Configuration reloaded")
+	loaded := &loadedConfig{modTime: info.ModTime()}
+	if err := json.Unmarshal(data, &loaded.config); err != nil {
+		return nil, err
+	}
+	return loaded, nil
 }
 
 func (cm *ConfigManager) GetConfig() Config {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-
-	return cm.config
+	return cm.manager.Get().config
 }
 
 func (cm *ConfigManager) GetDatabaseConfig() (string, int, string) {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-
-	db := cm.config.Database
+	db := cm.manager.Get().config.Database
 	return db.Host, db.Port, db.Username
 }
 
-func (cm *ConfigManager) watchConfig() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+// LastModified returns the modification time of the loaded config file
+func (cm *ConfigManager) LastModified() time.Time {
+	return cm.manager.Get().modTime
+}
 
-	for range ticker.C {
-		// Check if config file was modified
-		// In real implementation, you'd use file system events
-		cm.loadConfig()
-	}
+func (cm *ConfigManager) Close() error {
+	return cm.manager.Close()
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "testing"
+    
+    "github.com/harshithgowdakt/learn-go/config"
+)
+
+// rwMutexConfig is how ConfigManager read its config before the config
+// package: an RWMutex taken on every GetConfig
+type rwMutexConfig struct {
+    mu     sync.RWMutex
+    config Config
+}
+
+func (c *rwMutexConfig) GetConfig() Config {
+    c.mu.RLock()
+    defer c.mu.RUnlock()
+    
+    return c.config
+}
+
+func (c *rwMutexConfig) SetConfig(config Config) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    
+    c.config = config
+}
+
+// snapshotConfig reads through config.Manager
+type snapshotConfig struct {
+    manager *config.Manager[Config]
+}
+
+func (c *snapshotConfig) GetConfig() Config {
+    return *c.manager.Get()
+}
+
+func (c *snapshotConfig) SetConfig(cfg Config) {
+    c.manager.Set(&cfg)
+}
+
+type benchConfig interface {
+    GetConfig() Config
+    SetConfig(Config)
+}
+
+// benchmarkConfig reads in parallel; every writeEvery-th operation
+// publishes a new config, 0 means read only
+func benchmarkConfig(c benchConfig, writeEvery int) testing.BenchmarkResult {
+    return testing.Benchmark(func(b *testing.B) {
+        b.RunParallel(func(pb *testing.PB) {
+            i := 0
+            for pb.Next() {
+                i++
+                if writeEvery > 0 && i%writeEvery == 0 {
+                    cfg := c.GetConfig()
+                    cfg.API.RateLimit = i
+                    c.SetConfig(cfg)
+                    continue
+                }
+                if c.GetConfig().Database.Port < 0 {
+                    b.Fatal("impossible port")
+                }
+            }
+        })
+    })
+}
+
+// Usage - compare RWMutex reads with atomic snapshot reads
+func main() {
+    var initial Config
+    initial.Database.Host = "localhost"
+    initial.Database.Port = 5432
+    
+    manager, err := config.New(config.Options[Config]{
+        Load: func() (*Config, error) {
+            cfg := initial
+            return &cfg, nil
+        },
+    })
+    if err != nil {
+        fmt.Println("Error creating config manager:", err)
+        return
+    }
+    defer manager.Close()
+    
+    configs := []struct {
+        name   string
+        config benchConfig
+    }{
+        {"RWMutex", &rwMutexConfig{config: initial}},
+        {"atomic snapshot", &snapshotConfig{manager: manager}},
+    }
+    
+    for _, writeEvery := range []int{0, 1000, 100} {
+        for _, c := range configs {
+            mix := "reads only"
+            if writeEvery > 0 {
+                mix = fmt.Sprintf("1 write per %d", writeEvery)
+            }
+            result := benchmarkConfig(c.config, writeEvery)
+            fmt.Printf("%-16s %-18s %s\n", c.name, mix, result)
+        }
+    }
+}
\ No newline at end of file